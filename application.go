@@ -1,16 +1,23 @@
 package lemon
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/ouyangshangwen/lemon/utils"
+	"io/fs"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"regexp/syntax"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,36 +29,83 @@ type Application struct {
 	ExtraParams        map[string]interface{}
 	XSRFCookie         bool   // flag of enable xsrf default false
 	Debug              bool   // shorthand for serveral debug default true
-	CookieSecret       string // used by RequestHandler.GetSecureCookie and RequestHandler.SetCecureCookie to sign cookies
+	CookieSecret       string // used by RequestHandler.GetSecureCookie and RequestHandler.SetCecureCookie to sign cookies, a map of key id to secret is accepted too
+	CookieSecrets      map[string]string // all the cookie secrets by key id, built from CookieSecret
+	CookieKeyVersion   string // the key id of CookieSecrets signing new cookies
+	CookieMaxAge       int    // secure cookies older than CookieMaxAge seconds are rejected default 31 days
+	SessionStore       SessionStore // keeps the sessions, "memory", "file" or "cookie" in settings default "memory"
+	SessionCookie      string       // name of the session cookie default "session_id"
+	SessionMaxAge      int          // sessions expire after SessionMaxAge seconds default 14 days
+	SessionPath        string       // directory of the "file" session store default the temporary directory
+	SessionKey         string       // encryption key of the "cookie" session store, sessions are only signed if empty
+	LoginUrl           string // unauthenticated users of handlers tagged `authenticated` are redirected here
 	Expires            int    // the secret cookie expiration time after Expires seconds
 	TemplatePath       string // Directory containing template files
+	TemplateFS         fs.FS  // the templates are read from TemplateFS instead of TemplatePath if set, e.g. an embed.FS
 	LeftBraces         string // the left mark of template veriable default "{{"
 	RightBraces        string // the right mark of template veriable default "}}"
+	PrecompileTemplates bool  // parse and check all the templates at Init and panic on any error, they are only logged otherwise
+	RenderBufferSize   int    // bytes of a page held by Render before the response starts, an error of the template until then gives an error page default 64KB, 0 streams at once, -1 holds the whole page
 	Handlers           []HostPattern
 	DefaultHost        string
+	ScriptName         string // path prefix the application is mounted on, added by ReverseUrl, the FastCGI SCRIPT_NAME of a request replaces it
 	StaticPath         string //Directory from which static files will be served
+	StaticFS           fs.FS  // the static files are served from StaticFS instead of StaticPath if set, e.g. an embed.FS
 	IsGzip             bool   // if or not use gzip compress in response
 	NameHandlers       map[string]UrlSpec
 	AbsWorkPath        string        // the absolute path of current workspace
 	MaxMemory          int           //defalut 64MB
+	FCGIMaxBodyBytes   int           // bytes of the body of a FastCGI request held in memory, the request is aborted beyond default 64MB, 0 no limit
 	ReadTimeOut        time.Duration // maximum duration before timing out read of the request
 	WriteTimeOut       time.Duration // maximum duration before timing out write of the response
+	ShutdownTimeOut    time.Duration // maximum duration waiting for in-flight requests on shutdown default 10 seconds, 0 waits forever
+	GracefulRestart    bool // on SIGUSR2 start the executable again with the listening sockets and shut down once it serves
+	HttpsRedirect      bool // redirect the http requests to https
+	HttpsPort          int  // port of the https redirects default the port of the first https listener, else 443
+	HstsMaxAge         int  // max-age in seconds of the Strict-Transport-Security header of the https responses, 0 sends none
+	HstsIncludeSubdomains bool // add includeSubDomains to the Strict-Transport-Security header
+	HstsPreload        bool // add preload to the Strict-Transport-Security header
 	CertFile           string
 	KeyFile            string
-	IsCustomedTemplate bool   // if true use customed template engine, must implement the method RenderByte of RequestHandler
+	Certificates       map[string]CertificateFiles // certificates by host name (SNI), "*.example.com" matches one label, CertFile is the default
+	TLSMinVersion      string   // minimum TLS version "1.0", "1.1", "1.2" or "1.3" default "1.2"
+	TLSCipherSuites    []string // cipher suites of TLS 1.0 to 1.2 by name, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", default the ones of crypto/tls
+	TLSReloadInterval  int      // the certificate files are checked every TLSReloadInterval seconds and reloaded if changed default 10, 0 disables
+	ClientAuth         string   // client certificates asked, "none", "request", "require", "verify-if-given" or "require-and-verify" default "require-and-verify" if ClientCAFile is set, else "none"
+	ClientCAFile       string   // PEM bundle of the CAs verifying the client certificates
+	ProxyProtocol      []string // CIDRs of the load balancers sending a PROXY protocol v1 or v2 header, empty disables
+	TrustedProxies     []string // CIDRs of the proxies whose proxy headers are believed, empty trusts the peer of the connection only if Xheaders is on
+	ProxyHeader        string   // the header the trusted proxies give the client address in, "X-Forwarded-For", "X-Real-Ip" or "Forwarded" default "X-Forwarded-For"
+	IsCustomedTemplate bool   // Deprecated: register a TemplateEngine in TemplateEngines instead. If true there is no default template engine
+	TemplateEngines    map[string]TemplateEngine // template engines by extension of the template name, e.g. ".txt", "" is the default one, Templates unless set
 	ServerName         string // server name exported in response header.
 	Xheaders           bool
 	NUMCPU             int // the count of used cup default 1
+	Processes          int // worker processes started by Loop, sharing the listeners with SO_REUSEPORT default 0 serves in one process, -1 starts one per CPU
+	Autoreload         bool   // development mode, rebuild and restart on a change of the go files, parse the templates again on a change of TemplatePath
+	AutoreloadPackage  string // the main package built by Autoreload default "." the working directory
+	middlewares        []Middleware
+	routingMiddlewares []Middleware // run before the route is resolved
+	proxyNetworks      []*net.IPNet // parsed ProxyProtocol
+	trustedProxies     []*net.IPNet // parsed TrustedProxies
+	sessionStoreName   string
+	buildOutput        *atomic.Value // output of the go build of Autoreload which failed, "" once a build succeeds, shared by the copies of the handlers
+	templateWatcher    *fileWatcher // the template files checked before a render in Debug
 }
 
 func NewApplication() *Application {
-	return &Application{}
+	return &Application{NameHandlers: map[string]UrlSpec{}}
 
 }
 
 func (app *Application) Init(urlSpecs []UrlSpec, settings map[string]interface{}) {
 	app.setDefaultValue()
 	app.parseSettings(settings)
+	app.initCookieSecrets()
+	app.initSessionStore()
+	app.initHttps()
+	app.initProxyProtocol()
+	app.initTrustedProxies()
 	numCPU := runtime.NumCPU()
 	if app.NUMCPU != 1 {
 		if int(app.NUMCPU) > numCPU {
@@ -67,36 +121,65 @@ func (app *Application) Init(urlSpecs []UrlSpec, settings map[string]interface{}
 	workPath, _ := os.Getwd()
 	AbsWorkPath, _ := filepath.Abs(workPath)
 	app.AbsWorkPath = AbsWorkPath
-	app.NameHandlers = map[string]UrlSpec{}
+	if app.NameHandlers == nil {
+		app.NameHandlers = map[string]UrlSpec{}
+	}
+	app.buildOutput = &atomic.Value{}
 
-	if len(app.StaticPath) != 0 {
+	if len(app.StaticPath) != 0 || app.StaticFS != nil {
+		kwargs := map[string]interface{}{"path": app.StaticPath}
+		if app.StaticFS != nil {
+			kwargs["fs"] = app.StaticFS
+		}
 		statics := [3]string{"/static/(.*)", "/(favicon.ico)", "/(robots.txt)"}
 		for _, static := range statics {
 			staticHander := &StaticFileHandler{}
 			//			var self HandlerInterface
 			//			self = staticHander
 			urlSpec := AddRouter(static,
-				staticHander, map[string]interface{}{"path": app.StaticPath}, "")
+				staticHander, kwargs, "")
 			//Handlers = append(Handlers, urlHandler)
 			urlSpecs = append(urlSpecs, urlSpec)
 		}
 
 	}
 
-	if app.Handlers == nil {
-		app.AddHandlers(".*$", urlSpecs)
-	}
+	app.addInitHandlers(".*$", urlSpecs)
 	if !app.IsCustomedTemplate {
 		Templates = TemplateInit(app.LeftBraces, app.RightBraces)
-		var templatePath string
-		if len(app.TemplatePath) == 0 {
-			templatePath = filepath.Join(app.AbsWorkPath, "/templates/")
-		} else {
-			templatePath = app.TemplatePath
-		}
-		Templates.BuildTemplate(templatePath)
 	}
+	app.loadTemplates()
+
+}
+
+// templatePath returns TemplatePath, the templates directory of the working
+// directory if it is not set.
+func (app *Application) templatePath() string {
+	if len(app.TemplatePath) == 0 {
+		return filepath.Join(app.AbsWorkPath, "/templates/")
+	}
+	return app.TemplatePath
+}
+
+// templateFS returns TemplateFS, the directory of templatePath if it is not
+// set.
+func (app *Application) templateFS() fs.FS {
+	if app.TemplateFS != nil {
+		return app.TemplateFS
+	}
+	return os.DirFS(app.templatePath())
+}
 
+// staticFS returns StaticFS, the directory StaticPath if it is not set, nil
+// if there are no static files.
+func (app *Application) staticFS() fs.FS {
+	if app.StaticFS != nil {
+		return app.StaticFS
+	}
+	if len(app.StaticPath) == 0 {
+		return nil
+	}
+	return os.DirFS(app.StaticPath)
 }
 
 func (app *Application) setDefaultValue() {
@@ -109,15 +192,24 @@ func (app *Application) setDefaultValue() {
 	app.IsCustomedTemplate = false
 
 	app.MaxMemory = 1 << 26 //64MB
+	app.FCGIMaxBodyBytes = 1 << 26
 	app.IsGzip = false
 	app.Expires = 0
+	app.CookieMaxAge = 31 * 24 * 60 * 60
+	app.SessionCookie = "session_id"
+	app.SessionMaxAge = 14 * 24 * 60 * 60
 
 	app.LeftBraces = "{{"
 	app.RightBraces = "}}"
+	app.RenderBufferSize = 64 << 10
 	app.ServerName = "LemonServer"
 	app.NUMCPU = 1
 	app.ReadTimeOut = time.Duration(0) * time.Second
 	app.WriteTimeOut = time.Duration(0) * time.Second
+	app.ShutdownTimeOut = time.Duration(10) * time.Second
+	app.TLSMinVersion = "1.2"
+	app.TLSReloadInterval = 10
+	app.AutoreloadPackage = "."
 
 }
 
@@ -138,6 +230,25 @@ func (app *Application) parseSettings(settings map[string]interface{}) {
 				app.WriteTimeOut = time.Duration(writeTimeOut) * time.Second
 				continue
 			}
+			if key == "ShutdownTimeOut" {
+				shutdownTimeOut, _ := value.(int)
+				app.ShutdownTimeOut = time.Duration(shutdownTimeOut) * time.Second
+				continue
+			}
+			if key == "CookieSecret" && app.parseCookieSecrets(value) {
+				continue
+			}
+			if key == "Certificates" && app.parseCertificates(value) {
+				continue
+			}
+			if name, ok := value.(string); ok && key == "SessionStore" {
+				app.sessionStoreName = name
+				continue
+			}
+			if key == "CookieKeyVersion" {
+				app.CookieKeyVersion = fmt.Sprint(value)
+				continue
+			}
 			switch appValue.FieldByName(key).Kind() {
 			case reflect.Int:
 				IntValue, _ := value.(int)
@@ -148,6 +259,11 @@ func (app *Application) parseSettings(settings map[string]interface{}) {
 			case reflect.Bool:
 				BoolVaue, _ := value.(bool)
 				appValue.FieldByName(key).SetBool(BoolVaue)
+			default:
+				field := appValue.FieldByName(key)
+				if value != nil && reflect.TypeOf(value).AssignableTo(field.Type()) {
+					field.Set(reflect.ValueOf(value))
+				}
 			}
 		} else {
 			app.ExtraParams[key] = value
@@ -156,6 +272,96 @@ func (app *Application) parseSettings(settings map[string]interface{}) {
 	}
 }
 
+// parseCookieSecrets reads a CookieSecret setting given as a map of key id
+// to secret, it returns false if value is not such a map.
+func (app *Application) parseCookieSecrets(value interface{}) bool {
+	secrets := map[string]string{}
+	switch value := value.(type) {
+	case map[string]string:
+		for keyVersion, secret := range value {
+			secrets[keyVersion] = secret
+		}
+	case map[int]string:
+		for keyVersion, secret := range value {
+			secrets[strconv.Itoa(keyVersion)] = secret
+		}
+	case map[string]interface{}:
+		for keyVersion, secret := range value {
+			secrets[keyVersion] = fmt.Sprint(secret)
+		}
+	default:
+		return false
+	}
+	app.CookieSecrets = secrets
+	return true
+}
+
+// initCookieSecrets checks the cookie secrets, without any secret Init
+// fails unless Debug is on, then a random secret lasting until the
+// process exits is used.
+func (app *Application) initCookieSecrets() {
+	secrets := map[string]string{}
+	for keyVersion, secret := range app.CookieSecrets {
+		secrets[keyVersion] = secret
+	}
+	if len(app.CookieSecret) != 0 {
+		secrets[defaultKeyVersion] = app.CookieSecret
+	}
+	if len(secrets) == 0 {
+		if !app.Debug {
+			errLog := "CookieSecret must be set when Debug is false"
+			lemonLag.Error(errLog)
+			panic(errLog)
+		}
+		lemonLag.Warning("CookieSecret is not set, secure cookies are signed with a random secret until restart")
+		secrets[defaultKeyVersion] = string(utils.RandomCreateBytes(32))
+	}
+	if len(app.CookieKeyVersion) == 0 {
+		if len(secrets) != 1 {
+			errLog := "CookieKeyVersion must be set when CookieSecret has several keys"
+			lemonLag.Error(errLog)
+			panic(errLog)
+		}
+		for keyVersion := range secrets {
+			app.CookieKeyVersion = keyVersion
+		}
+	}
+	if _, ok := secrets[app.CookieKeyVersion]; !ok {
+		errLog := fmt.Sprintf("CookieKeyVersion %s not found in CookieSecret", app.CookieKeyVersion)
+		lemonLag.Error(errLog)
+		panic(errLog)
+	}
+	app.CookieSecrets = secrets
+}
+
+// initSessionStore creates the session store named in the settings, if
+// the settings do not give a SessionStore.
+func (app *Application) initSessionStore() {
+	if app.SessionStore != nil {
+		return
+	}
+	var err error
+	switch app.sessionStoreName {
+	case "", "memory":
+		app.SessionStore = NewMemorySessionStore(0)
+	case "file":
+		path := app.SessionPath
+		if len(path) == 0 {
+			path = filepath.Join(os.TempDir(), "lemon_sessions")
+		}
+		app.SessionStore, err = NewFileSessionStore(path)
+	case "cookie":
+		app.SessionStore, err = NewCookieSessionStore(app.SessionKey)
+	default:
+		err = errors.New(fmt.Sprintf("unknown session store %s", app.sessionStoreName))
+	}
+	if err != nil {
+		errLog := fmt.Sprintf("cannot create the session store: %v", err)
+		lemonLag.Error(errLog)
+		panic(errLog)
+	}
+}
+
 //Appends the given handlers to our handler list.
 //
 //Host patterns are processed sequentially in the order they were
@@ -171,17 +377,7 @@ func (app *Application) AddHandlers(hostPattern string, hosthandlers []UrlSpec)
 	//	hostPatternEntry.handlers = hosthandlers
 	hostPatternEntry := NewHostPattern(hostPattern, hosthandlers)
 	for _, spec := range hosthandlers {
-		name := spec.Name
-		if len(name) != 0 {
-			_, ok := app.NameHandlers[name]
-			if ok {
-				errLog := fmt.Sprintf("Multiple handlers named %s; replacing previous value", name)
-				lemonLag.Error(errLog)
-				panic(errLog)
-			}
-			app.NameHandlers[name] = spec
-		}
-
+		app.addNamedHandler(spec)
 	}
 
 	length := len(app.Handlers)
@@ -194,80 +390,169 @@ func (app *Application) AddHandlers(hostPattern string, hosthandlers []UrlSpec)
 
 }
 
-func (app *Application) _getHostHandler(request *HttpRequest) []UrlSpec {
-	hostList := strings.Split(request.Host(), ":")
-	host := hostList[0]
-	var matches []UrlSpec
-	for _, hostpattern := range app.Handlers {
+func (app *Application) addNamedHandler(spec UrlSpec) {
+	name := spec.Name
+	if len(name) != 0 {
+		if app.NameHandlers == nil {
+			app.NameHandlers = map[string]UrlSpec{}
+		}
+		_, ok := app.NameHandlers[name]
+		if ok {
+			errLog := fmt.Sprintf("Multiple handlers named %s; replacing previous value", name)
+			lemonLag.Error(errLog)
+			panic(errLog)
+		}
+		app.NameHandlers[name] = spec
+	}
+}
+
+// addInitHandlers adds the handlers given to Init for hostPattern, before
+// the ones added by the groups created before Init.
+func (app *Application) addInitHandlers(hostPattern string, hosthandlers []UrlSpec) {
+	if len(hosthandlers) == 0 {
+		return
+	}
+	for i := range app.Handlers {
+		if app.Handlers[i].Pattern() == hostPattern {
+			for _, spec := range hosthandlers {
+				app.addNamedHandler(spec)
+			}
+			handlers := append(append([]UrlSpec{}, hosthandlers...), app.Handlers[i].handlers...)
+			app.Handlers[i] = NewHostPattern(hostPattern, handlers)
+			return
+		}
+	}
+	app.AddHandlers(hostPattern, hosthandlers)
+}
+
+// addUrlSpec appends spec to the handlers of hostPattern, which are
+// created if the host pattern was not added yet.
+func (app *Application) addUrlSpec(hostPattern string, spec UrlSpec) {
+	if !strings.HasSuffix(hostPattern, "$") {
+		hostPattern = hostPattern + "$"
+	}
+	for i := range app.Handlers {
+		if app.Handlers[i].Pattern() == hostPattern {
+			app.addNamedHandler(spec)
+			app.Handlers[i].addUrlSpec(spec)
+			return
+		}
+	}
+	app.AddHandlers(hostPattern, []UrlSpec{spec})
+}
+
+func (app *Application) _getHostHandler(request *HttpRequest) *HostPattern {
+	host := request.HostName()
+	var matches *HostPattern
+	for i, hostpattern := range app.Handlers {
 		match := hostpattern.hostCompiled.MatchString(host)
 		if match {
-			matches = hostpattern.handlers
+			matches = &app.Handlers[i]
 		}
 
 	}
 	//Look for default host if not behind load balancer (for debugging)
-	if len(matches) == 0 && len(request.HeaderDefault("X-Real-Ip", "")) == 0 {
-		for _, hostpattern := range app.Handlers {
+	if matches == nil && len(request.HeaderDefault("X-Real-Ip", "")) == 0 {
+		for i, hostpattern := range app.Handlers {
 			match := hostpattern.hostCompiled.MatchString(app.DefaultHost)
 			if match {
-				matches = hostpattern.handlers
+				matches = &app.Handlers[i]
 			}
 		}
 	}
 	return matches
 }
 
-// ServeHTTP dispatches the request to the handler whose
-// pattern most closely matches the request URL.
+// ServeHTTP dispatches the request to the first handler whose
+// pattern matches the request URL.
+//
+// The middlewares added by UseBeforeRouting run first, before the route is
+// resolved. The middlewares added by Use run next, once the route is
+// resolved, then the ones of the route, around the handler. When no route
+// matches they run around the not found response, with a nil
+// RouteContext.Spec.
 func (app *Application) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	//time.Sleep(100 * time.Microsecond)
-	var handler HandlerInterface
-
+	if output := app.buildFailure(); len(output) != 0 {
+		serveBuildFailure(rw, output)
+		return
+	}
 	request := NewHttpRequest(r, app.Xheaders, app.MaxMemory)
-	handlers := app._getHostHandler(request)
-	var args []string
-
-	kwargs := NullDictionary()
-	if len(handlers) == 0 {
+	request.trustedProxies = app.trustedProxies
+	request.proxyHeader = app.ProxyHeader
+	if len(request.ScriptName) == 0 {
+		request.ScriptName = app.ScriptName
+	}
+	ctx := &RouteContext{Application: app, Request: request, ResponseWriter: rw}
+	runMiddlewares(app.routingMiddlewares, ctx, func() {
+		// the middlewares may have rewritten the host
+		request.client = nil
+		app.route(ctx)
+	})
+}
 
-		redirecthandler := &RedirectHandler{}
+// route resolves the route of the request of ctx and runs it.
+func (app *Application) route(ctx *RouteContext) {
+	request, r := ctx.Request, ctx.Request.Request
+	hostPattern := app._getHostHandler(request)
+	if hostPattern == nil || len(hostPattern.handlers) == 0 {
+		runMiddlewares(app.middlewares, ctx, func() {
+			var args []string
+			kwargs := NullDictionary()
+			redirecthandler := &RedirectHandler{}
+
+			kwargs["Url"] = "http://" + app.DefaultHost + r.RequestURI
+			kwargs["permanent"] = true
+			redirecthandler.Init(redirecthandler, request, ctx.ResponseWriter, app, kwargs) // #
+			redirecthandler.Execute(args)
+		})
+		return
+	}
 
-		kwargs["Url"] = "http://" + app.DefaultHost + r.RequestURI
-		kwargs["permanent"] = true
-		redirecthandler.Init(redirecthandler, request, rw, app, kwargs)
-		//redirecthandler.Url = "http://" + app.DefaultHost + "/"
-		handler = redirecthandler
-		redirecthandler.Init(handler, request, rw, app, kwargs) // #
-		redirecthandler.Execute(args)
+	match, ok := hostPattern.router.lookup(request.Url())
+	if !ok {
+		runMiddlewares(app.middlewares, ctx, func() {
+			app.NotFound(ctx.ResponseWriter, r)
+		})
+		return
+	}
+	spec := match.spec
+	request.PathArguments = match.pathArguments
+	request.PathValues = match.pathValues
+	ctx.Spec = spec
+	ctx.Name = spec.Name
+	if spec.Kwargs != nil {
+		// the middlewares and the handler may change it, the route keeps its own
+		ctx.Kwargs = mergeDictionary(spec.Kwargs, nil)
+	}
+	ctx.Args = match.args
+	runMiddlewares(app.middlewares, ctx, func() {
+		runMiddlewares(spec.middlewares, ctx, func() {
+			app.executeHandler(ctx)
+		})
+	})
+}
 
-	} else {
-		for _, spec := range handlers {
-			match := spec.Regexps.MatchString(request.Url())
-			if match {
-				handler = spec.HandlerClass
-
-				args = spec.Regexps.FindStringSubmatch(request.Url())[1:]
-				kwargs = spec.Kwargs
-
-		        instance := reflect.New(spec.HandlerType)
-		        instanceHandlerInterface, ok := instance.Interface().(HandlerInterface)
-                if !ok {
-                    panic("is not HandlerInterface")
-                }else {
-                    instanceHandlerInterface.Init(instanceHandlerInterface, request, rw, app, kwargs) // #
-                    instanceHandlerInterface.Execute(args)
-                }
-			}
-		}
+// Use appends middlewares run around every request, see ServeHTTP.
+func (app *Application) Use(middlewares ...Middleware) {
+	app.middlewares = append(app.middlewares, middlewares...)
+}
 
-	}
+// UseBeforeRouting appends middlewares run around every request before its
+// route is resolved, see ServeHTTP. They may rewrite the path or the host
+// of ctx.Request.Request to change the route.
+func (app *Application) UseBeforeRouting(middlewares ...Middleware) {
+	app.routingMiddlewares = append(app.routingMiddlewares, middlewares...)
+}
 
-	if handler == nil {
-		app.NotFound(rw, r)
-	}else {
-        handler = nil
+// executeHandler creates a new handler of the matched route and runs it.
+func (app *Application) executeHandler(ctx *RouteContext) {
+	instance := reflect.New(ctx.Spec.HandlerType)
+	handler, ok := instance.Interface().(HandlerInterface)
+	if !ok {
+		panic("is not HandlerInterface")
 	}
-
+	handler.Init(handler, ctx.Request, ctx.ResponseWriter, app, ctx.Kwargs) // #
+	handler.Execute(ctx.Args)
 }
 
 func (app *Application) NotFound(rw http.ResponseWriter, r *http.Request) {
@@ -290,7 +575,14 @@ func (app *Application) NotFound(rw http.ResponseWriter, r *http.Request) {
 //	The handler must be added to the application as a named `URLSpec`.
 //
 //	Args will be substituted for capturing groups in the `URLSpec` regex.
+//	The url is prefixed by ``ScriptName``, `RequestHandler.ReverseUrl`
+//	uses the prefix of the request instead.
 func (app *Application) ReverseUrl(name string, params ...string) string {
+	return app.reverseUrl(app.ScriptName, name, params...)
+}
+
+// reverseUrl is ReverseUrl for an application mounted on scriptName.
+func (app *Application) reverseUrl(scriptName, name string, params ...string) string {
 	urlSpec, ok := app.NameHandlers[name]
 	if !ok {
 		errLog := fmt.Sprintf("%s not found in named urls", name)
@@ -302,13 +594,39 @@ func (app *Application) ReverseUrl(name string, params ...string) string {
 		errLog := fmt.Sprintf("%v", err.Error())
 		panic(errLog)
 	}
-	return url
+	return scriptName + url
+}
+
+//	Returns a URL path for handler named ``name``, like `ReverseUrl`
+//
+//	Kwargs will be substituted for the named groups in the `URLSpec`
+//	pattern, such as ``{id:int}``.
+func (app *Application) ReverseUrlKwargs(name string, kwargs Dictionary) string {
+	return app.reverseUrlKwargs(app.ScriptName, name, kwargs)
+}
+
+// reverseUrlKwargs is ReverseUrlKwargs for an application mounted on
+// scriptName.
+func (app *Application) reverseUrlKwargs(scriptName, name string, kwargs Dictionary) string {
+	urlSpec, ok := app.NameHandlers[name]
+	if !ok {
+		errLog := fmt.Sprintf("%s not found in named urls", name)
+		lemonLag.Error(errLog)
+		panic(errLog)
+	}
+	url, err := urlSpec.ReverseKwargs(kwargs)
+	if err != nil {
+		errLog := fmt.Sprintf("%v", err.Error())
+		panic(errLog)
+	}
+	return scriptName + url
 }
 
 //Specifies mappings between hosts and UrlSpecs.
 type HostPattern struct {
 	hostCompiled *regexp.Regexp
 	handlers     []UrlSpec
+	router       *router
 }
 
 func (hp *HostPattern) Pattern() string {
@@ -319,25 +637,44 @@ func NewHostPattern(hostPattern string, hosthandlers []UrlSpec) HostPattern {
 	hostComiled, _ := regexp.Compile(hostPattern)
 	hostPatternEntry.hostCompiled = hostComiled
 	hostPatternEntry.handlers = hosthandlers
+	hostPatternEntry.router = newRouter(hosthandlers)
 	return hostPatternEntry
 }
 
+func (hp *HostPattern) addUrlSpec(spec UrlSpec) {
+	hp.handlers = append(hp.handlers, spec)
+	hp.router.add(spec)
+}
+
 //Specifies mappings between URLs and handlers.
 type UrlSpec struct {
 	Name         string
 	pattern      string
 	HandlerClass HandlerInterface
-    HandlerType reflect.Type
+	HandlerType  reflect.Type
 	Kwargs       Dictionary
 	Regexps      *regexp.Regexp
-	path         string
+	converters   map[string]Converter // converters of the named path parameters
+	pieces       []urlPiece           // literals and groups used to reverse the url, nil if it can't be reversed
+	middlewares  []Middleware         // run around the handler
+	methods      []string             // HTTP methods answered by the handler
 	GroupCount   int
 }
 
+// urlPiece is a part of a reversed url: a literal or a capturing group.
+type urlPiece struct {
+	literal string
+	capture bool
+	name    string         // name of the group, empty for unnamed groups
+	regexp  *regexp.Regexp // what the value of the group must match
+}
+
 //	    Parameters:
 //        * ``pattern``: Regular expression to be matched.  Any groups
 //          in the regex will be passed in to the handler's get/post/etc
-//          methods as arguments.
+//          methods as arguments. ``{name}`` or ``{name:converter}``
+//          declares a named path parameter, see `Converter`, the
+//          converters "str", "int", "uuid", "slug" and "path" are built in.
 //
 //        * ``handlerclass``: `RequestHandler` subclass to be invoked.
 //
@@ -353,6 +690,11 @@ func NewUrlSpec(pattern string, handlerclass HandlerInterface,
 	instanceType := reflect.Indirect(instanceValue).Type()
 
 	urlspec := UrlSpec{}
+	pattern, pathConverters, err := compilePathParams(pattern)
+	if err != nil {
+		lemonLag.Error(err)
+		panic(err.Error())
+	}
 	if !strings.HasSuffix(pattern, "$") {
 		pattern = pattern + "$"
 	}
@@ -363,9 +705,16 @@ func NewUrlSpec(pattern string, handlerclass HandlerInterface,
 	urlspec.pattern = pattern
 	urlspec.Name = name
 	urlspec.HandlerClass = handlerclass
-    urlspec.HandlerType = instanceType 
-	urlspec.Regexps, _ = regexp.Compile(pattern)
-	urlspec.path, urlspec.GroupCount = urlspec.findGroups()
+	urlspec.HandlerType = instanceType
+	urlspec.methods = allowedMethods(instanceType)
+	urlspec.Regexps, err = regexp.Compile(pattern)
+	if err != nil {
+		errLog := fmt.Sprintf("invalid url pattern %s: %v", pattern, err)
+		lemonLag.Error(errLog)
+		panic(errLog)
+	}
+	urlspec.converters = pathConverters
+	urlspec.pieces, urlspec.GroupCount = urlspec.findGroups()
 	urlspec.Kwargs = params
 	return urlspec
 
@@ -375,59 +724,138 @@ func (urls *UrlSpec) Pattern() string {
 	return urls.pattern
 }
 
-func (urls *UrlSpec) findGroups() (string, int) {
-	/*Returns a tuple (reverse string, group count) for a url.
-	For example: Given the url pattern /([0-9]{4})/([a-z-]+)/, this method
-	would return ('/%s/%s/', 2).
-	*/
-	pattern := urls.pattern
-	if strings.HasPrefix(pattern, "^") {
-		pattern = pattern[1:]
-	}
-	if strings.HasSuffix(pattern, "$") {
-		pattern = pattern[:len(pattern)]
-	}
-	if numsubexp, parenCount := urls.Regexps.NumSubexp(),
-		strings.Count(pattern, "("); numsubexp != parenCount {
-		// The pattern is too complicated for our simplistic matching,
-		// so we can't support reversing it.
-		return "", 0
-	}
-
-	pieces := []string{}
-	for _, franment := range strings.Split(pattern, "(") {
-		if strings.Contains(franment, ")") {
-			parenLoc := strings.Index(franment, ")")
-			if parenLoc >= 0 {
-				franment = fmt.Sprintf("%s%s", "%s", franment[parenLoc+1:])
-				pieces = append(pieces, franment)
-			}
+// Methods returns the HTTP methods answered by the handler of the route.
+func (urls *UrlSpec) Methods() []string {
+	return urls.methods
+}
 
-		} else {
-			pieces = append(pieces, franment)
+// match matches path against the pattern, it returns the captured groups,
+// the named ones, and the named ones converted by their Converter.
+func (urls *UrlSpec) match(path string) (*routeMatch, bool) {
+	groups := urls.Regexps.FindStringSubmatch(path)
+	if groups == nil {
+		return nil, false
+	}
+	match := &routeMatch{spec: urls, args: groups[1:]}
+	for i, name := range urls.Regexps.SubexpNames() {
+		if i == 0 || name == "" {
+			continue
+		}
+		if match.pathArguments == nil {
+			match.pathArguments = map[string]string{}
+			match.pathValues = map[string]interface{}{}
+		}
+		match.pathArguments[name] = groups[i]
+		converter, ok := urls.converters[name]
+		if !ok {
+			match.pathValues[name] = groups[i]
+			continue
 		}
+		value, err := converter.ToValue(groups[i])
+		if err != nil {
+			return nil, false
+		}
+		match.pathValues[name] = value
+	}
+	return match, true
+}
 
+func (urls *UrlSpec) findGroups() ([]urlPiece, int) {
+	/*Returns the pieces of the reversed url and the group count.
+	For example: Given the url pattern /([0-9]{4})/([a-z-]+)/, this method
+	would return ['/', group, '/', group, '/'] and 2. Groups may nest, only
+	the outermost ones are substituted.
+	*/
+	re, err := syntax.Parse(urls.pattern, syntax.Perl)
+	if err != nil {
+		return nil, 0
+	}
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
 	}
 
-	return strings.Join(pieces, ""), urls.Regexps.NumSubexp()
+	pieces := []urlPiece{}
+	groupCount := 0
+	for _, sub := range subs {
+		switch sub.Op {
+		case syntax.OpBeginText, syntax.OpEndText, syntax.OpEmptyMatch:
+		case syntax.OpLiteral:
+			pieces = append(pieces, urlPiece{literal: string(sub.Rune)})
+		case syntax.OpCapture:
+			groupRegexp, err := regexp.Compile("^(?:" + sub.Sub[0].String() + ")$")
+			if err != nil {
+				return nil, 0
+			}
+			pieces = append(pieces, urlPiece{capture: true, name: sub.Name, regexp: groupRegexp})
+			groupCount++
+		default:
+			// The pattern is too complicated for our simplistic matching,
+			// so we can't support reversing it.
+			return nil, 0
+		}
+	}
+	return pieces, groupCount
 }
 
 func (urls *UrlSpec) Reverse(args ...string) (string, error) {
-	if urls.path == "" {
+	if urls.pieces == nil {
 		return "", errors.New(fmt.Sprintf("Cannot reverse url regex %s", urls.pattern))
 	}
 	if int(len(args)) != urls.GroupCount {
 		return "", errors.New("required number of arguments not found")
 	}
-	if ok := int8(len(args)); ok == 0 {
-		return urls.path, nil
+	var reversed bytes.Buffer
+	for _, piece := range urls.pieces {
+		if piece.capture {
+			reversed.WriteString(args[0])
+			args = args[1:]
+		} else {
+			reversed.WriteString(piece.literal)
+		}
 	}
-	converted_args := []interface{}{}
-	for _, arg := range args {
-		converted_args = append(converted_args, arg)
+	return reversed.String(), nil
+}
+
+// ReverseKwargs is like Reverse but substitutes the named groups of the
+// pattern with the values of kwargs, formatted by their Converter and
+// escaped.
+func (urls *UrlSpec) ReverseKwargs(kwargs Dictionary) (string, error) {
+	if urls.pieces == nil {
+		return "", errors.New(fmt.Sprintf("Cannot reverse url regex %s", urls.pattern))
 	}
-	//fmt.Println(urls.path, converted_args)
-	return fmt.Sprintf(urls.path, converted_args...), nil
+	var reversed bytes.Buffer
+	for _, piece := range urls.pieces {
+		if !piece.capture {
+			reversed.WriteString(piece.literal)
+			continue
+		}
+		if piece.name == "" {
+			return "", errors.New(fmt.Sprintf("Cannot reverse unnamed group of %s by name", urls.pattern))
+		}
+		value, ok := kwargs[piece.name]
+		if !ok {
+			return "", errors.New(fmt.Sprintf("argument %s not found", piece.name))
+		}
+		var str string
+		if converter, ok := urls.converters[piece.name]; ok {
+			var err error
+			if str, err = converter.ToUrl(value); err != nil {
+				return "", err
+			}
+		} else {
+			str = fmt.Sprint(value)
+		}
+		if !piece.regexp.MatchString(str) {
+			return "", errors.New(fmt.Sprintf("argument %s=%q does not match %s", piece.name, str, urls.pattern))
+		}
+		segments := strings.Split(str, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		reversed.WriteString(strings.Join(segments, "/"))
+	}
+	return reversed.String(), nil
 }
 
 type Dictionary map[string]interface{}
@@ -436,6 +864,10 @@ func NullDictionary() Dictionary {
 	return Dictionary{}
 }
 
-func AddRouter(pattern string, handler HandlerInterface, params Dictionary, name string) UrlSpec {
-	return NewUrlSpec(pattern, handler, name, params)
+// AddRouter is a shorthand of NewUrlSpec, the middlewares run around the
+// handler of this route only.
+func AddRouter(pattern string, handler HandlerInterface, params Dictionary, name string, middlewares ...Middleware) UrlSpec {
+	urlspec := NewUrlSpec(pattern, handler, name, params)
+	urlspec.middlewares = middlewares
+	return urlspec
 }
@@ -0,0 +1,113 @@
+package lemon
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// authRequirement tells which requests of a handler type need a logged in
+// user. It is declared with the "authenticated" tag of a field of the
+// handler, usually the embedded RequestHandler:
+//
+//	type AdminHandler struct {
+//		lemon.RequestHandler `authenticated:"true"`      // every method
+//	}
+//	type CommentHandler struct {
+//		lemon.RequestHandler `authenticated:"POST,DELETE"` // only these methods
+//	}
+//	type ApiHandler struct {
+//		lemon.RequestHandler `authenticated:"true" api:"true"` // 403, never redirected
+//	}
+type authRequirement struct {
+	required bool
+	methods  []string // nil means every method
+	api      bool
+}
+
+var authRequirementsCache sync.Map
+
+func handlerAuthRequirement(handlerType reflect.Type) authRequirement {
+	if requirement, ok := authRequirementsCache.Load(handlerType); ok {
+		return requirement.(authRequirement)
+	}
+	requirement := findAuthRequirement(handlerType)
+	authRequirementsCache.Store(handlerType, requirement)
+	return requirement
+}
+
+func findAuthRequirement(structType reflect.Type) authRequirement {
+	if structType.Kind() != reflect.Struct {
+		return authRequirement{}
+	}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		tag, ok := field.Tag.Lookup("authenticated")
+		if !ok || tag == "false" || tag == "" {
+			continue
+		}
+		requirement := authRequirement{required: true, api: field.Tag.Get("api") == "true"}
+		if tag != "true" && tag != "*" {
+			for _, method := range strings.Split(tag, ",") {
+				requirement.methods = append(requirement.methods, strings.ToUpper(strings.TrimSpace(method)))
+			}
+		}
+		return requirement
+	}
+	// the tag may be declared by an embedded base handler
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if !field.Anonymous {
+			continue
+		}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if requirement := findAuthRequirement(fieldType); requirement.required {
+			return requirement
+		}
+	}
+	return authRequirement{}
+}
+
+func (requirement authRequirement) requires(method string) bool {
+	if !requirement.required {
+		return false
+	}
+	if requirement.methods == nil {
+		return true
+	}
+	for _, m := range requirement.methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNilUser reports whether user is nil, or a nil pointer, map, ...
+func isNilUser(user interface{}) bool {
+	if user == nil {
+		return true
+	}
+	value := reflect.ValueOf(user)
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface, reflect.Func, reflect.Chan:
+		return value.IsNil()
+	}
+	return false
+}
+
+// addNextArgument appends the "next" query argument to loginUrl.
+func addNextArgument(loginUrl, next string) string {
+	parsed, err := url.Parse(loginUrl)
+	if err != nil {
+		return loginUrl
+	}
+	query := parsed.Query()
+	query.Set("next", next)
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
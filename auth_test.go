@@ -0,0 +1,145 @@
+package lemon
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+type account struct {
+	name string
+}
+
+// userHandler is logged in as the X-User header, a typed nil *account if
+// it is "nil".
+type userHandler struct {
+	RequestHandler
+}
+
+func (h *userHandler) GetCurrentUser() interface{} {
+	switch user := h.Request.Header("X-User"); user {
+	case "":
+		return nil
+	case "nil":
+		return (*account)(nil)
+	default:
+		return &account{user}
+	}
+}
+
+func (h *userHandler) Get(args ...string) {
+	h.Write([]byte("ok"))
+}
+
+func (h *userHandler) Post(args ...string) {
+	h.Write([]byte("ok"))
+}
+
+func (h *userHandler) Delete(args ...string) {
+	h.Write([]byte("ok"))
+}
+
+type adminHandler struct {
+	userHandler `authenticated:"true"`
+}
+
+type commentHandler struct {
+	userHandler `authenticated:"POST,DELETE"`
+}
+
+type apiHandler struct {
+	userHandler `authenticated:"true" api:"true"`
+}
+
+// inheritedHandler requires a user through the tag of adminHandler.
+type inheritedHandler struct {
+	adminHandler
+}
+
+func authApp(loginUrl string) *Application {
+	app := NewApplication()
+	app.Init([]UrlSpec{
+		AddRouter("/admin", &adminHandler{}, nil, ""),
+		AddRouter("/comments", &commentHandler{}, nil, ""),
+		AddRouter("/api", &apiHandler{}, nil, ""),
+		AddRouter("/inherited", &inheritedHandler{}, nil, ""),
+		AddRouter("/public", &userHandler{}, nil, ""),
+	}, map[string]interface{}{"CookieSecret": "secret", "LoginUrl": loginUrl})
+	return app
+}
+
+func TestAuthenticated(t *testing.T) {
+	tests := []struct {
+		loginUrl string
+		method   string
+		path     string
+		user     string
+		ajax     bool
+		code     int
+		location string
+	}{
+		{"/login", "GET", "/admin?page=2", "", false, 302, "/login?next=%2Fadmin%3Fpage%3D2"},
+		{"/login?lang=en", "GET", "/admin", "", false, 302, "/login?lang=en&next=%2Fadmin"},
+		{"https://sso.example.com/login", "GET", "/admin", "", false, 302, "https://sso.example.com/login?next=http%3A%2F%2Fexample.com%2Fadmin"},
+		{"/login", "HEAD", "/admin", "", false, 302, "/login?next=%2Fadmin"},
+		{"/login", "GET", "/admin", "bob", false, 200, ""},
+		{"/login", "GET", "/admin", "nil", false, 302, "/login?next=%2Fadmin"},
+		{"/login", "POST", "/admin", "", false, 403, ""},
+		{"/login", "GET", "/admin", "", true, 403, ""},
+		{"", "GET", "/admin", "", false, 403, ""},
+		{"/login", "GET", "/comments", "", false, 200, ""},
+		{"/login", "POST", "/comments", "", false, 403, ""},
+		{"/login", "DELETE", "/comments", "", false, 403, ""},
+		{"/login", "DELETE", "/comments", "bob", false, 200, ""},
+		{"/login", "GET", "/api", "", false, 403, ""},
+		{"/login", "GET", "/api", "nil", false, 403, ""},
+		{"/login", "GET", "/api", "bob", false, 200, ""},
+		{"/login", "GET", "/inherited", "", false, 302, "/login?next=%2Finherited"},
+		{"/login", "POST", "/public", "", false, 200, ""},
+	}
+	apps := map[string]*Application{}
+	for _, test := range tests {
+		app, ok := apps[test.loginUrl]
+		if !ok {
+			app = authApp(test.loginUrl)
+			apps[test.loginUrl] = app
+		}
+		r := httptest.NewRequest(test.method, "http://example.com"+test.path, nil)
+		if len(test.user) != 0 {
+			r.Header.Set("X-User", test.user)
+		}
+		if test.ajax {
+			r.Header.Set("X-Requested-With", "XMLHttpRequest")
+		}
+		rw := httptest.NewRecorder()
+		app.ServeHTTP(rw, r)
+		if rw.Code != test.code || rw.Header().Get("Location") != test.location {
+			t.Errorf("%s %s as %q with LoginUrl %q: %d %q, want %d %q", test.method, test.path, test.user,
+				test.loginUrl, rw.Code, rw.Header().Get("Location"), test.code, test.location)
+		}
+	}
+}
+
+func TestIsNilUser(t *testing.T) {
+	var nilMap map[string]string
+	var nilInterface interface{}
+	tests := []struct {
+		user interface{}
+		want bool
+	}{
+		{nil, true},
+		{nilInterface, true},
+		{(*account)(nil), true},
+		{nilMap, true},
+		{[]string(nil), true},
+		{&account{"bob"}, false},
+		{"", false},
+		{0, false},
+		{account{}, false},
+		{map[string]string{}, false},
+	}
+	for _, test := range tests {
+		if got := isNilUser(test.user); got != test.want {
+			t.Errorf("isNilUser(%#v) = %v, want %v", test.user, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package lemon
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Autoreload: the development mode checks every autoreloadInterval the go
+// files of the module, the templates and the static files. A change of a
+// go file builds AutoreloadPackage into a temporary executable which
+// replaces the process like Restart does, so the listeners stay open and
+// no request is refused. While the build fails every request gets the
+// compiler output. A change of the templates parses them again in the
+// process, a change of the static files drops their compressed copies.
+const autoreloadInterval = time.Second
+
+// autoreloadPrefix starts the name of the executables built by Autoreload.
+const autoreloadPrefix = "lemon-autoreload-"
+
+// fileTimes are the modification times of the files watched.
+type fileTimes map[string]time.Time
+
+// scanFiles returns the modification times of the files under root, the go
+// files but the tests if sources is true. The hidden directories are
+// skipped, and vendor and testdata for the sources.
+func scanFiles(root string, sources bool) fileTimes {
+	files := fileTimes{}
+	if len(root) == 0 {
+		return files
+	}
+	for name, modTime := range scanFS(os.DirFS(root), sources) {
+		files[filepath.Join(root, filepath.FromSlash(name))] = modTime
+	}
+	return files
+}
+
+// scanFS is scanFiles for the files of fsys, by their name in fsys.
+func scanFS(fsys fs.FS, sources bool) fileTimes {
+	files := fileTimes{}
+	if fsys == nil {
+		return files
+	}
+	fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if path != "." && (strings.HasPrefix(name, ".") || (sources && (name == "vendor" || name == "testdata"))) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if sources && (!strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go")) {
+			return nil
+		}
+		if f, err := d.Info(); err == nil {
+			files[path] = f.ModTime()
+		}
+		return nil
+	})
+	return files
+}
+
+// changed returns the files added, modified or removed since before.
+func (files fileTimes) changed(before fileTimes) []string {
+	changed := []string{}
+	for path, modTime := range files {
+		if previous, ok := before[path]; !ok || !previous.Equal(modTime) {
+			changed = append(changed, path)
+		}
+	}
+	for path := range before {
+		if _, ok := files[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// watchInterval is how often a fileWatcher scans the files at most.
+var watchInterval = time.Second
+
+// fileWatcher tells when the files of an fs.FS changed, for the templates
+// checked before they are rendered. The files are scanned at most once per
+// watchInterval and by one goroutine at a time, which also runs the reload,
+// the others go on with the current files meanwhile.
+type fileWatcher struct {
+	lock     sync.Mutex // held while scanning and reloading
+	lastScan time.Time
+	modTimes fileTimes
+}
+
+// reset records modTimes as the times of the files loaded.
+func (w *fileWatcher) reset(modTimes fileTimes) {
+	w.lock.Lock()
+	w.modTimes = modTimes
+	w.lock.Unlock()
+}
+
+// check calls reload if a file of fsys was added, modified or removed
+// since reset or the last reload.
+func (w *fileWatcher) check(fsys fs.FS, reload func()) {
+	if fsys == nil || !w.lock.TryLock() {
+		return
+	}
+	defer w.lock.Unlock()
+	if time.Since(w.lastScan) < watchInterval {
+		return
+	}
+	w.lastScan = time.Now()
+	current := scanFS(fsys, false)
+	if len(current.changed(w.modTimes)) == 0 {
+		return
+	}
+	w.modTimes = current
+	reload()
+}
+
+// moduleRoot returns the directory of the go.mod above dir, dir itself if
+// there is none.
+func moduleRoot(dir string) string {
+	for current := dir; ; {
+		if _, err := os.Stat(filepath.Join(current, "go.mod")); err == nil {
+			return current
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return dir
+		}
+		current = parent
+	}
+}
+
+// autoreload watches the files until stopped is closed, the executables
+// built after a change of the go files are sent on rebuilt. The executable
+// of the process is removed on return if it is one of them.
+func (lem *Lemon) autoreload(rebuilt chan<- string, stopped <-chan struct{}) {
+	app := lem.app
+	sourceRoot := moduleRoot(app.AbsWorkPath)
+	sources := scanFiles(sourceRoot, true)
+	templates := scanFS(app.templateFS(), false)
+	statics := scanFS(app.staticFS(), false)
+	lemonLag.Info(fmt.Sprintf("Autoreload watching %s", sourceRoot))
+	ticker := time.NewTicker(autoreloadInterval)
+	defer ticker.Stop()
+	defer removeBuild()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopped:
+			return
+		}
+		if current := scanFS(app.templateFS(), false); len(current.changed(templates)) != 0 {
+			templates = current
+			lemonLag.Info("templates changed, parsing them again")
+			if err := app.ReloadTemplates(); err != nil {
+				lemonLag.Error(err.Error())
+			}
+		}
+		if current := scanFS(app.staticFS(), false); len(current.changed(statics)) != 0 {
+			statics = current
+			clearMemZipFiles()
+		}
+		current := scanFiles(sourceRoot, true)
+		changed := current.changed(sources)
+		if len(changed) == 0 {
+			continue
+		}
+		sources = current
+		lemonLag.Info(fmt.Sprintf("%s changed, building %s", changed[0], app.AutoreloadPackage))
+		executable, err := app.build()
+		if err != nil {
+			lemonLag.Error(err.Error())
+			app.buildOutput.Store(err.Error())
+			continue
+		}
+		app.buildOutput.Store("")
+		select {
+		case rebuilt <- executable:
+		case <-stopped:
+			os.Remove(executable)
+			return
+		}
+	}
+}
+
+// build runs go build of AutoreloadPackage in the working directory and
+// returns the executable, or an error with the output of the compiler.
+func (app *Application) build() (string, error) {
+	executable := filepath.Join(os.TempDir(), fmt.Sprintf("%s%d", autoreloadPrefix, os.Getpid()))
+	if runtime.GOOS == "windows" {
+		executable += ".exe"
+	}
+	cmd := exec.Command("go", "build", "-o", executable, app.AutoreloadPackage)
+	cmd.Dir = app.AbsWorkPath
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("go build %s: %v\n%s", app.AutoreloadPackage, err, output))
+	}
+	return executable, nil
+}
+
+// restartBuild replaces the process by executable, built by autoreload. It
+// returns false if the new process does not serve, the error is then shown
+// like a failed build.
+func (lem *Lemon) restartBuild(executable string) bool {
+	lemonLag.Info(fmt.Sprintf("restarting with %s", executable))
+	if err := lem.restart(executable); err != nil {
+		errLog := fmt.Sprintf("Restart: %v", err)
+		lemonLag.Error(errLog)
+		lem.app.buildOutput.Store(errLog)
+		os.Remove(executable)
+		return false
+	}
+	return true
+}
+
+// removeBuild removes the executable of the process if autoreload built
+// it, once the process stops serving.
+func removeBuild() {
+	if current, err := os.Executable(); err == nil && strings.HasPrefix(filepath.Base(current), autoreloadPrefix) {
+		os.Remove(current)
+	}
+}
+
+// buildFailure returns the error of the last build of Autoreload, "" if it
+// succeeded.
+func (app *Application) buildFailure() string {
+	if app.buildOutput == nil {
+		return ""
+	}
+	output, _ := app.buildOutput.Load().(string)
+	return output
+}
+
+// serveBuildFailure answers a request with the output of a failed build.
+func serveBuildFailure(rw http.ResponseWriter, output string) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(rw, `<html><title>Build failed</title><body>
+<pre style="word-wrap: break-word; white-space: pre-wrap;">%s</pre>
+</body></html>`, html.EscapeString(output))
+}
@@ -0,0 +1,40 @@
+package lemon
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestBuildFailure checks the output of a failed build is shown instead of
+// the pages, while the handlers copying the Application run, with -race.
+func TestBuildFailure(t *testing.T) {
+	app := NewApplication()
+	app.Init([]UrlSpec{AddRouter("/.*", &getOnlyHandler{}, nil, "")}, map[string]interface{}{"CookieSecret": "secret"})
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				app.buildOutput.Store("")
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		serveGet(app, "/")
+	}
+	close(stop)
+	wg.Wait()
+	if code, body := serveGet(app, "/"); code != 200 || body != "get" {
+		t.Errorf("after a successful build: %d %q", code, body)
+	}
+	app.buildOutput.Store("main.go:3: undefined: <x>")
+	if code, body := serveGet(app, "/"); code != 500 || !strings.Contains(body, "main.go:3: undefined: &lt;x&gt;") {
+		t.Errorf("after a failed build: %d %q", code, body)
+	}
+}
@@ -0,0 +1,222 @@
+package lemon
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertificateFiles is a PEM encoded certificate chain and its private key.
+type CertificateFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseCertificates reads a Certificates setting given as a map of host
+// name to the certificate and key files, it returns false if value is not
+// such a map.
+func (app *Application) parseCertificates(value interface{}) bool {
+	certificates := map[string]CertificateFiles{}
+	switch value := value.(type) {
+	case map[string]CertificateFiles:
+		for name, files := range value {
+			certificates[name] = files
+		}
+	case map[string][2]string:
+		for name, files := range value {
+			certificates[name] = CertificateFiles{files[0], files[1]}
+		}
+	case map[string][]string:
+		for name, files := range value {
+			if len(files) != 2 {
+				return false
+			}
+			certificates[name] = CertificateFiles{files[0], files[1]}
+		}
+	default:
+		return false
+	}
+	app.Certificates = certificates
+	return true
+}
+
+// hasCertificates reports whether a certificate is configured.
+func (app *Application) hasCertificates() bool {
+	return len(app.CertFile) != 0 || len(app.KeyFile) != 0 || len(app.Certificates) != 0
+}
+
+// certificateStore selects the certificate of a TLS handshake by the
+// server name the client asked for (SNI) and reloads the certificates when
+// their files change. CertFile and KeyFile give the default certificate,
+// used for the clients sending no or an unknown server name.
+type certificateStore struct {
+	files    map[string]CertificateFiles // by lowercase host name, "" is the default
+	mu       sync.RWMutex
+	loaded   map[string]*tls.Certificate
+	modTimes map[string]time.Time // of every file when the certificates were loaded
+}
+
+func newCertificateStore(app *Application) *certificateStore {
+	files := map[string]CertificateFiles{}
+	for name, pair := range app.Certificates {
+		files[strings.ToLower(name)] = pair
+	}
+	if len(app.CertFile) != 0 || len(app.KeyFile) != 0 {
+		files[""] = CertificateFiles{app.CertFile, app.KeyFile}
+	}
+	return &certificateStore{files: files}
+}
+
+// load reads every certificate, the certificates in use are kept if one of
+// them fails.
+func (cs *certificateStore) load() error {
+	loaded := map[string]*tls.Certificate{}
+	modTimes := map[string]time.Time{}
+	for name, pair := range cs.files {
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			info, err := os.Stat(file)
+			if err != nil {
+				return errors.New(fmt.Sprintf("certificate of %q: %v", name, err))
+			}
+			modTimes[file] = info.ModTime()
+		}
+		certificate, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return errors.New(fmt.Sprintf("certificate of %q: %v", name, err))
+		}
+		loaded[name] = &certificate
+	}
+	cs.mu.Lock()
+	cs.loaded = loaded
+	cs.modTimes = modTimes
+	cs.mu.Unlock()
+	return nil
+}
+
+// changed reports whether a file was modified since the certificates were
+// loaded.
+func (cs *certificateStore) changed() bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for file, modTime := range cs.modTimes {
+		info, err := os.Stat(file)
+		if err == nil && !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload loads the certificates again, an error is logged and the
+// certificates in use are kept.
+func (cs *certificateStore) reload() {
+	if err := cs.load(); err != nil {
+		lemonLag.Error(fmt.Sprintf("Reloading the certificates: %v, keeping the ones in use", err))
+		return
+	}
+	lemonLag.Info("certificates reloaded")
+}
+
+// watch reloads the certificates every interval if their files changed,
+// until stop is closed.
+func (cs *certificateStore) watch(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if cs.changed() {
+				cs.reload()
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// GetCertificate returns the certificate of the exact server name, then of
+// a wildcard "*.example.com" matching one label, then of "*", then the
+// default one.
+func (cs *certificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	candidates := []string{"", "*"}
+	if len(name) != 0 {
+		candidates = []string{name}
+		if i := strings.Index(name, "."); i > 0 {
+			candidates = append(candidates, "*"+name[i:])
+		}
+		candidates = append(candidates, "*", "")
+	}
+	for _, candidate := range candidates {
+		if certificate, ok := cs.loaded[candidate]; ok {
+			return certificate, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("no certificate for %q", hello.ServerName))
+}
+
+// names returns the host names having a certificate, for the logs.
+func (cs *certificateStore) names() []string {
+	names := []string{}
+	for name := range cs.files {
+		if len(name) == 0 {
+			name = "default"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tlsConfig returns a copy of the TLS configuration of Server with the
+// certificates of the store, the version and cipher policy and the client
+// authentication of app.
+func tlsConfig(app *Application, base *tls.Config, store *certificateStore) (*tls.Config, error) {
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+	if len(app.TLSMinVersion) != 0 {
+		version, ok := tlsVersions[app.TLSMinVersion]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("unknown TLSMinVersion %s, must be 1.0, 1.1, 1.2 or 1.3", app.TLSMinVersion))
+		}
+		config.MinVersion = version
+	}
+	if len(app.TLSCipherSuites) != 0 {
+		suites := map[string]uint16{}
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, suite := range tls.InsecureCipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		config.CipherSuites = []uint16{}
+		for _, name := range app.TLSCipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("unknown cipher suite %s", name))
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+	if err := setClientAuth(app, config); err != nil {
+		return nil, err
+	}
+	config.GetCertificate = store.GetCertificate
+	return config, nil
+}
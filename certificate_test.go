@@ -0,0 +1,154 @@
+package lemon
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate is a certificate written to PEM files, signed by its
+// parent or self-signed.
+type testCertificate struct {
+	cert  *x509.Certificate
+	key   *ecdsa.PrivateKey
+	files CertificateFiles
+}
+
+// newTestCertificate writes the certificate of template to name.pem and
+// its key to name-key.pem in dir.
+func newTestCertificate(t *testing.T, dir, name string, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := CertificateFiles{filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")}
+	writeTemplate(t, dir, name+".pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeTemplate(t, dir, name+"-key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})))
+	return &testCertificate{cert: cert, key: key, files: files}
+}
+
+// commonNameOf returns the common name of the certificate selected for
+// serverName, or the error.
+func commonNameOf(store *certificateStore, serverName string) string {
+	certificate, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		return err.Error()
+	}
+	cert, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return err.Error()
+	}
+	return cert.Subject.CommonName
+}
+
+func TestCertificateStoreSelection(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]CertificateFiles{}
+	for _, name := range []string{"example.com", "*.example.com", "api.example.com", "*"} {
+		files[name] = newTestCertificate(t, dir, filepath.Base(name), &x509.Certificate{Subject: pkix.Name{CommonName: name}}, nil).files
+	}
+	def := newTestCertificate(t, dir, "default", &x509.Certificate{Subject: pkix.Name{CommonName: "default"}}, nil)
+
+	tests := []struct {
+		certificates []string
+		serverName   string
+		commonName   string
+	}{
+		{[]string{"example.com", "*.example.com", "api.example.com"}, "example.com", "example.com"},
+		{[]string{"example.com", "*.example.com", "api.example.com"}, "EXAMPLE.com.", "example.com"},
+		{[]string{"example.com", "*.example.com", "api.example.com"}, "api.example.com", "api.example.com"},
+		{[]string{"example.com", "*.example.com", "api.example.com"}, "www.example.com", "*.example.com"},
+		{[]string{"example.com", "*.example.com", "api.example.com"}, "a.www.example.com", "default"},
+		{[]string{"example.com", "*.example.com", "api.example.com"}, "example.org", "default"},
+		{[]string{"example.com", "*.example.com", "api.example.com"}, "", "default"},
+		{[]string{"example.com", "*"}, "example.org", "*"},
+		{[]string{"example.com", "*"}, "", "*"},
+	}
+	for _, test := range tests {
+		app := &Application{Certificates: map[string]CertificateFiles{}, CertFile: def.files.CertFile, KeyFile: def.files.KeyFile}
+		if test.commonName != "default" {
+			app.CertFile, app.KeyFile = "", ""
+		}
+		for _, name := range test.certificates {
+			app.Certificates[name] = files[name]
+		}
+		store := newCertificateStore(app)
+		if err := store.load(); err != nil {
+			t.Fatal(err)
+		}
+		if commonName := commonNameOf(store, test.serverName); commonName != test.commonName {
+			t.Errorf("%v %q: %s, want %s", test.certificates, test.serverName, commonName, test.commonName)
+		}
+	}
+
+	store := newCertificateStore(&Application{Certificates: map[string]CertificateFiles{"example.com": files["example.com"]}})
+	if err := store.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.org"}); err == nil {
+		t.Error("a certificate for an unknown name without default")
+	}
+}
+
+func TestCertificateStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCertificate(t, dir, "site", &x509.Certificate{Subject: pkix.Name{CommonName: "first"}}, nil)
+	store := newCertificateStore(&Application{CertFile: first.files.CertFile, KeyFile: first.files.KeyFile})
+	if err := store.load(); err != nil {
+		t.Fatal(err)
+	}
+	if store.changed() {
+		t.Error("changed before any change")
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go store.watch(10*time.Millisecond, stop)
+
+	// the files are rewritten with a later modification time
+	newTestCertificate(t, dir, "site", &x509.Certificate{Subject: pkix.Name{CommonName: "second-certificate"}}, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for commonNameOf(store, "example.com") != "second-certificate" {
+		if time.Now().After(deadline) {
+			t.Fatalf("not reloaded: %s", commonNameOf(store, "example.com"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a broken key keeps the certificate in use
+	writeTemplate(t, dir, "site-key.pem", "broken key, and a new modification time")
+	store.reload()
+	if commonName := commonNameOf(store, "example.com"); commonName != "second-certificate" {
+		t.Errorf("after a failed reload: %s", commonName)
+	}
+	if !store.changed() {
+		t.Error("the broken key is not tried again")
+	}
+}
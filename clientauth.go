@@ -0,0 +1,181 @@
+package lemon
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+// ClientCertificate is the identity of a client authenticated by a
+// certificate verified against ClientCAFile.
+type ClientCertificate struct {
+	Subject        pkix.Name
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	Fingerprint    string              // hex encoded SHA-256 of the certificate
+	Certificate    *x509.Certificate   // the certificate of the client
+	Chain          []*x509.Certificate // the verified chain, from the client certificate to the CA
+}
+
+// SANs returns the subject alternative names of the certificate: the DNS
+// names, email addresses, IP addresses and URIs.
+func (cc *ClientCertificate) SANs() []string {
+	sans := []string{}
+	sans = append(sans, cc.DNSNames...)
+	sans = append(sans, cc.EmailAddresses...)
+	for _, ip := range cc.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cc.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+// ClientCertificate returns the verified certificate of the client, nil if
+// the request is not over TLS or the client sent no certificate verified
+// by ClientCAFile.
+func (hr *HttpRequest) ClientCertificate() *ClientCertificate {
+	state := hr.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	chain := state.VerifiedChains[0]
+	leaf := chain[0]
+	sum := sha256.Sum256(leaf.Raw)
+	return &ClientCertificate{
+		Subject:        leaf.Subject,
+		DNSNames:       leaf.DNSNames,
+		EmailAddresses: leaf.EmailAddresses,
+		IPAddresses:    leaf.IPAddresses,
+		URIs:           leaf.URIs,
+		Fingerprint:    hex.EncodeToString(sum[:]),
+		Certificate:    leaf,
+		Chain:          chain,
+	}
+}
+
+// RequireClientCertificate returns a Middleware answering 403 to the
+// requests without a verified client certificate, or whose certificate
+// matches none of patterns. A pattern "CN=...", "O=..." or "OU=..." is
+// matched against that attribute of the subject, any other pattern against
+// the subject alternative names. "*" matches any characters and the case
+// is ignored, e.g.
+//
+//	lemon.AddRouter("/internal/.*", &InternalHandler{}, nil, "",
+//		lemon.RequireClientCertificate("*.svc.example.com", "CN=billing-*"))
+//
+// Without patterns every verified certificate is accepted.
+func RequireClientCertificate(patterns ...string) Middleware {
+	return func(ctx *RouteContext, next func()) {
+		certificate := ctx.Request.ClientCertificate()
+		if certificate == nil || !certificate.matches(patterns) {
+			http.Error(ctx.ResponseWriter, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next()
+	}
+}
+
+// matches reports whether the certificate matches one of patterns, or
+// patterns is empty.
+func (cc *ClientCertificate) matches(patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		var values []string
+		switch {
+		case hasPrefixFold(pattern, "CN="):
+			pattern, values = pattern[3:], []string{cc.Subject.CommonName}
+		case hasPrefixFold(pattern, "O="):
+			pattern, values = pattern[2:], cc.Subject.Organization
+		case hasPrefixFold(pattern, "OU="):
+			pattern, values = pattern[3:], cc.Subject.OrganizationalUnit
+		default:
+			values = cc.SANs()
+		}
+		for _, value := range values {
+			if matchGlob(strings.ToLower(pattern), strings.ToLower(value)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// matchGlob reports whether value matches pattern, where "*" matches any
+// characters.
+func matchGlob(pattern, value string) bool {
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, pattern[:i]) {
+		return false
+	}
+	value = value[i:]
+	pattern = pattern[i+1:]
+	for j := 0; j <= len(value); j++ {
+		if matchGlob(pattern, value[j:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// setClientAuth configures config to ask the clients for a certificate
+// following ClientAuth, verified against the CAs of ClientCAFile.
+func setClientAuth(app *Application, config *tls.Config) error {
+	mode := app.ClientAuth
+	if len(mode) == 0 {
+		if len(app.ClientCAFile) == 0 {
+			return nil
+		}
+		mode = "require-and-verify"
+	}
+	clientAuth, ok := clientAuthTypes[mode]
+	if !ok {
+		return errors.New(fmt.Sprintf("unknown ClientAuth %s, must be none, request, require, verify-if-given or require-and-verify", mode))
+	}
+	config.ClientAuth = clientAuth
+	if len(app.ClientCAFile) == 0 {
+		if clientAuth >= tls.VerifyClientCertIfGiven {
+			return errors.New(fmt.Sprintf("ClientAuth %s needs the CAs of ClientCAFile", mode))
+		}
+		return nil
+	}
+	pem, err := ioutil.ReadFile(app.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New(fmt.Sprintf("no certificate in ClientCAFile %s", app.ClientCAFile))
+	}
+	config.ClientCAs = pool
+	return nil
+}
@@ -0,0 +1,196 @@
+package lemon
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func newTestCA(t *testing.T, dir string) *testCertificate {
+	return newTestCertificate(t, dir, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newTestClient(t *testing.T, dir string, ca *testCertificate) *testCertificate {
+	uri, _ := url.Parse("spiffe://example.com/billing")
+	return newTestCertificate(t, dir, "client", &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "billing-worker", Organization: []string{"Example"}, OrganizationalUnit: []string{"Payments"}},
+		DNSNames:       []string{"billing.svc.example.com"},
+		EmailAddresses: []string{"billing@example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.7")},
+		URIs:           []*url.URL{uri},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	client := newTestClient(t, dir, ca)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if NewHttpRequest(r, false, 1<<20).ClientCertificate() != nil {
+		t.Error("a client certificate without TLS")
+	}
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client.cert}}
+	if NewHttpRequest(r, false, 1<<20).ClientCertificate() != nil {
+		t.Error("a client certificate without a verified chain")
+	}
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{client.cert, ca.cert}}
+	certificate := NewHttpRequest(r, false, 1<<20).ClientCertificate()
+	if certificate == nil {
+		t.Fatal("no client certificate")
+	}
+	sum := sha256.Sum256(client.cert.Raw)
+	if certificate.Fingerprint != hex.EncodeToString(sum[:]) {
+		t.Errorf("fingerprint %s", certificate.Fingerprint)
+	}
+	if certificate.Subject.CommonName != "billing-worker" || certificate.Certificate != client.cert || len(certificate.Chain) != 2 {
+		t.Errorf("subject %v, chain of %d", certificate.Subject, len(certificate.Chain))
+	}
+	sans := []string{"billing.svc.example.com", "billing@example.com", "10.0.0.7", "spiffe://example.com/billing"}
+	if !reflect.DeepEqual(certificate.SANs(), sans) {
+		t.Errorf("SANs %q, want %q", certificate.SANs(), sans)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, value string
+		match          bool
+	}{
+		{"billing.svc.example.com", "billing.svc.example.com", true},
+		{"billing.svc.example.com", "billing.svc.example.org", false},
+		{"*.svc.example.com", "billing.svc.example.com", true},
+		{"*.svc.example.com", "svc.example.com", false},
+		{"billing-*", "billing-worker", true},
+		{"billing-*", "billing-", true},
+		{"*", "", true},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "aXbY", false},
+		{"*@example.com", "billing@example.com", true},
+	}
+	for _, test := range tests {
+		if match := matchGlob(test.pattern, test.value); match != test.match {
+			t.Errorf("%q %q: %v", test.pattern, test.value, match)
+		}
+	}
+}
+
+func TestRequireClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	client := newTestClient(t, dir, ca)
+	tests := []struct {
+		patterns []string
+		code     int
+	}{
+		{nil, 200},
+		{[]string{"*.svc.example.com"}, 200},
+		{[]string{"*.SVC.example.com"}, 200},
+		{[]string{"CN=billing-*"}, 200},
+		{[]string{"cn=BILLING-WORKER"}, 200},
+		{[]string{"O=Example"}, 200},
+		{[]string{"OU=Pay*"}, 200},
+		{[]string{"billing@example.com"}, 200},
+		{[]string{"10.0.0.*"}, 200},
+		{[]string{"spiffe://example.com/*"}, 200},
+		{[]string{"*.other.example.com", "CN=billing-*"}, 200},
+		{[]string{"*.other.example.com"}, 403},
+		{[]string{"CN=*.svc.example.com"}, 403},
+		{[]string{"O=Other"}, 403},
+		{[]string{"OU=Billing"}, 403},
+		{[]string{"billing-worker"}, 403},
+	}
+	for _, test := range tests {
+		app := NewApplication()
+		app.Init([]UrlSpec{AddRouter("/.*", &getOnlyHandler{}, nil, "", RequireClientCertificate(test.patterns...))},
+			map[string]interface{}{"CookieSecret": "secret"})
+		r := httptest.NewRequest("GET", "https://example.com/", nil)
+		r.TLS.VerifiedChains = [][]*x509.Certificate{{client.cert, ca.cert}}
+		rw := httptest.NewRecorder()
+		app.ServeHTTP(rw, r)
+		if rw.Code != test.code {
+			t.Errorf("%q: %d, want %d", test.patterns, rw.Code, test.code)
+		}
+		if code, _ := serveGet(app, "https://example.com/"); code != 403 {
+			t.Errorf("%q without a client certificate: %d", test.patterns, code)
+		}
+	}
+}
+
+// TestClientAuthHandshake checks the certificates signed by ClientCAFile
+// reach the handlers and the other ones are refused.
+func TestClientAuthHandshake(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	client := newTestClient(t, dir, ca)
+	other := newTestClient(t, t.TempDir(), newTestCA(t, t.TempDir()))
+	server := newTestCertificate(t, dir, "server", &x509.Certificate{Subject: pkix.Name{CommonName: "server"}, DNSNames: []string{"example.com"}}, ca)
+
+	app := NewApplication()
+	app.Init([]UrlSpec{AddRouter("/.*", &getOnlyHandler{}, nil, "", RequireClientCertificate("CN=billing-*"))},
+		map[string]interface{}{"CookieSecret": "secret", "CertFile": server.files.CertFile, "KeyFile": server.files.KeyFile,
+			"ClientCAFile": ca.files.CertFile})
+	store := newCertificateStore(app)
+	if err := store.load(); err != nil {
+		t.Fatal(err)
+	}
+	config, err := tlsConfig(app, nil, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("ClientAuth %v", config.ClientAuth)
+	}
+	ts := httptest.NewUnstartedServer(app)
+	ts.TLS = config
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certificate *testCertificate) (string, error) {
+		clientConfig := &tls.Config{RootCAs: roots, ServerName: "example.com"}
+		if certificate != nil {
+			pair, err := tls.LoadX509KeyPair(certificate.files.CertFile, certificate.files.KeyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConfig.Certificates = []tls.Certificate{pair}
+		}
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		defer httpClient.CloseIdleConnections()
+		response, err := httpClient.Get(ts.URL)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return string(body), nil
+	}
+	if body, err := get(client); err != nil || body != "get" {
+		t.Errorf("with a certificate of ClientCAFile: %q %v", body, err)
+	}
+	if _, err := get(other); err == nil {
+		t.Error("a certificate of another CA is accepted")
+	}
+	if _, err := get(nil); err == nil {
+		t.Error("a request without certificate is accepted")
+	}
+}
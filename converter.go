@@ -0,0 +1,102 @@
+package lemon
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Converter describes the type of a named path parameter.
+//
+// A pattern such as `/users/{id:int}` is compiled with the regex of the
+// "int" converter in place of `{id:int}`; when a request matches, the
+// captured string is passed through ToValue and handed to the handler, and
+// `Application.ReverseUrlKwargs` formats values back with ToUrl.
+type Converter interface {
+	Regexp() string                            // regex matched by the parameter, must not contain capturing groups
+	ToValue(value string) (interface{}, error) // converts a captured string, an error means the url does not match
+	ToUrl(value interface{}) (string, error)   // formats a value for the url, before escaping
+}
+
+type regexpConverter struct {
+	pattern string
+	toValue func(string) (interface{}, error)
+}
+
+// NewConverter returns a Converter matching pattern whose values are
+// converted by toValue, toValue may be nil to keep the captured string.
+func NewConverter(pattern string, toValue func(string) (interface{}, error)) Converter {
+	return &regexpConverter{pattern: pattern, toValue: toValue}
+}
+
+func (rc *regexpConverter) Regexp() string {
+	return rc.pattern
+}
+
+func (rc *regexpConverter) ToValue(value string) (interface{}, error) {
+	if rc.toValue == nil {
+		return value, nil
+	}
+	return rc.toValue(value)
+}
+
+func (rc *regexpConverter) ToUrl(value interface{}) (string, error) {
+	return fmt.Sprint(value), nil
+}
+
+var converters = map[string]Converter{
+	"str":  NewConverter("[^/]+", nil),
+	"int":  NewConverter("[0-9]+", func(value string) (interface{}, error) { return strconv.Atoi(value) }),
+	"uuid": NewConverter("[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}", func(value string) (interface{}, error) { return strings.ToLower(value), nil }),
+	"slug": NewConverter("[-a-zA-Z0-9_]+", nil),
+	"path": NewConverter(".+", nil),
+}
+var convertersLock sync.RWMutex
+
+// RegisterConverter makes converter available as `{name:converterName}`
+// in the patterns given to AddRouter, it must be called before the routes
+// using it are created.
+func RegisterConverter(name string, converter Converter) {
+	convertersLock.Lock()
+	defer convertersLock.Unlock()
+	converters[name] = converter
+}
+
+func getConverter(name string) (Converter, bool) {
+	convertersLock.RLock()
+	defer convertersLock.RUnlock()
+	converter, ok := converters[name]
+	return converter, ok
+}
+
+var pathParamRegexp = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)(?::([A-Za-z_][A-Za-z0-9_]*))?\}`)
+
+// compilePathParams replaces every `{name}` or `{name:converter}` of
+// pattern by a named group, and returns the converter of each name.
+// `{name}` uses the "str" converter which matches one path segment.
+func compilePathParams(pattern string) (string, map[string]Converter, error) {
+	params := map[string]Converter{}
+	var err error
+	pattern = pathParamRegexp.ReplaceAllStringFunc(pattern, func(param string) string {
+		groups := pathParamRegexp.FindStringSubmatch(param)
+		name, converterName := groups[1], groups[2]
+		if converterName == "" {
+			converterName = "str"
+		}
+		converter, ok := getConverter(converterName)
+		if !ok {
+			err = errors.New(fmt.Sprintf("unknown converter %s in %s", converterName, param))
+			return param
+		}
+		if _, ok := params[name]; ok {
+			err = errors.New(fmt.Sprintf("path parameter %s is used more than once", name))
+			return param
+		}
+		params[name] = converter
+		return fmt.Sprintf("(?P<%s>%s)", name, converter.Regexp())
+	})
+	return pattern, params, err
+}
@@ -0,0 +1,144 @@
+package lemon
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPathConverters(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		values  map[string]interface{} // nil if the path does not match
+	}{
+		{"/items/{id:int}", "/items/42", map[string]interface{}{"id": 42}},
+		{"/items/{id:int}", "/items/x", nil},
+		// the regexp matches but the conversion fails
+		{"/items/{id:int}", "/items/99999999999999999999", nil},
+		{"/u/{id:uuid}", "/u/0A1B2C3D-4E5F-6789-ABCD-EF0123456789", map[string]interface{}{"id": "0a1b2c3d-4e5f-6789-abcd-ef0123456789"}},
+		{"/u/{id:uuid}", "/u/0a1b2c3d", nil},
+		{"/s/{name:slug}", "/s/hello-world_1", map[string]interface{}{"name": "hello-world_1"}},
+		{"/s/{name:slug}", "/s/hello.world", nil},
+		{"/f/{file:path}", "/f/a/b/c.txt", map[string]interface{}{"file": "a/b/c.txt"}},
+		{"/n/{name}", "/n/bob", map[string]interface{}{"name": "bob"}},
+		{"/n/{name}", "/n/bob/x", nil},
+		{"/{year:int}/{slug}", "/2024/hello", map[string]interface{}{"year": 2024, "slug": "hello"}},
+	}
+	for _, test := range tests {
+		spec := AddRouter(test.pattern, &getOnlyHandler{}, nil, "")
+		match, ok := spec.match(test.path)
+		if test.values == nil {
+			if ok {
+				t.Errorf("%s matched %s: %v", test.pattern, test.path, match.pathValues)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s did not match %s", test.pattern, test.path)
+			continue
+		}
+		if !reflect.DeepEqual(match.pathValues, test.values) {
+			t.Errorf("%s %s: values %#v, want %#v", test.pattern, test.path, match.pathValues, test.values)
+		}
+		for name, value := range match.pathArguments {
+			if !strings.Contains(test.path, value) {
+				t.Errorf("%s %s: argument %s=%q not in the path", test.pattern, test.path, name, value)
+			}
+		}
+	}
+}
+
+// yearConverter matches four digits and formats the years with them.
+type yearConverter struct{}
+
+func (yearConverter) Regexp() string {
+	return "[0-9]{4}"
+}
+
+func (yearConverter) ToValue(value string) (interface{}, error) {
+	return strconv.Atoi(value)
+}
+
+func (yearConverter) ToUrl(value interface{}) (string, error) {
+	year, ok := value.(int)
+	if !ok {
+		return "", fmt.Errorf("year %v is not an int", value)
+	}
+	return fmt.Sprintf("%04d", year), nil
+}
+
+func TestRegisterConverter(t *testing.T) {
+	RegisterConverter("year", yearConverter{})
+	spec := AddRouter("/archive/{year:year}", &getOnlyHandler{}, nil, "")
+	if match, ok := spec.match("/archive/2024"); !ok || match.pathValues["year"] != 2024 {
+		t.Errorf("/archive/2024: %v %v", match, ok)
+	}
+	if _, ok := spec.match("/archive/24"); ok {
+		t.Error("/archive/24 matched")
+	}
+	if url, err := spec.ReverseKwargs(Dictionary{"year": 987}); err != nil || url != "/archive/0987" {
+		t.Errorf("ReverseKwargs: %q %v", url, err)
+	}
+	if _, err := spec.ReverseKwargs(Dictionary{"year": "2024"}); err == nil {
+		t.Error("ReverseKwargs formatted a string year")
+	}
+}
+
+func TestCompilePathParamsErrors(t *testing.T) {
+	for _, pattern := range []string{"/x/{id:nope}", "/x/{id}/{id:int}"} {
+		if _, _, err := compilePathParams(pattern); err == nil {
+			t.Errorf("%s compiled", pattern)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("AddRouter accepted an unknown converter")
+		}
+	}()
+	AddRouter("/x/{id:nope}", &getOnlyHandler{}, nil, "")
+}
+
+func TestReverseKwargs(t *testing.T) {
+	tests := []struct {
+		pattern string
+		kwargs  Dictionary
+		url     string // empty if an error is expected
+	}{
+		{"/items/{id:int}", Dictionary{"id": 42}, "/items/42"},
+		{"/items/{id:int}", Dictionary{"id": "x"}, ""},
+		{"/items/{id:int}", Dictionary{}, ""},
+		{"/files/{file:path}", Dictionary{"file": "a b/c.txt"}, "/files/a%20b/c.txt"},
+		{"/n/{name}", Dictionary{"name": "a/b"}, ""},
+		{"/{year:int}/{slug:slug}", Dictionary{"year": 2024, "slug": "hello"}, "/2024/hello"},
+		{"/items/([0-9]+)", Dictionary{"id": 1}, ""},
+	}
+	for _, test := range tests {
+		spec := AddRouter(test.pattern, &getOnlyHandler{}, nil, "")
+		url, err := spec.ReverseKwargs(test.kwargs)
+		if len(test.url) == 0 {
+			if err == nil {
+				t.Errorf("%s %v: %q, want an error", test.pattern, test.kwargs, url)
+			}
+			continue
+		}
+		if err != nil || url != test.url {
+			t.Errorf("%s %v: %q %v, want %q", test.pattern, test.kwargs, url, err, test.url)
+		}
+	}
+
+	app := NewApplication()
+	app.Init([]UrlSpec{AddRouter("/items/{id:int}", &getOnlyHandler{}, nil, "item")},
+		map[string]interface{}{"CookieSecret": "secret"})
+	if url := app.ReverseUrlKwargs("item", Dictionary{"id": 7}); url != "/items/7" {
+		t.Errorf("Application.ReverseUrlKwargs: %q", url)
+	}
+	if code, body := serveGet(app, "/items/7"); code != 200 || body != "get" {
+		t.Errorf("GET /items/7: %d %q", code, body)
+	}
+	if code, _ := serveGet(app, "/items/x"); code != 404 {
+		t.Errorf("GET /items/x: %d", code)
+	}
+}
@@ -0,0 +1,609 @@
+package lemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FastCGI responder, see https://fast-cgi.github.io/spec. It replaces
+// net/http/fcgi, which hides SCRIPT_NAME and PATH_INFO from the handlers and
+// can't be shut down gracefully.
+const (
+	fcgiVersion = 1
+
+	fcgiBeginRequest    = 1
+	fcgiAbortRequest    = 2
+	fcgiEndRequest      = 3
+	fcgiParams          = 4
+	fcgiStdin           = 5
+	fcgiStdout          = 6
+	fcgiStderr          = 7
+	fcgiData            = 8
+	fcgiGetValues       = 9
+	fcgiGetValuesResult = 10
+	fcgiUnknownType     = 11
+
+	fcgiResponder   = 1
+	fcgiKeepConn    = 1
+	fcgiComplete    = 0
+	fcgiUnknownRole = 3
+
+	fcgiMaxWrite = 65535 // maximum content length of a record
+)
+
+var errFcgiAborted = errors.New("FastCGI request aborted")
+
+type fcgiParamsKey struct{}
+
+// FastCGIParams returns the FastCGI params of a request served by FCGILoop,
+// nil for the other requests.
+func FastCGIParams(r *http.Request) map[string]string {
+	params, _ := r.Context().Value(fcgiParamsKey{}).(map[string]string)
+	return params
+}
+
+type fcgiHeader struct {
+	Version       uint8
+	Type          uint8
+	Id            uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+// fcgiServer serves the FastCGI connections of its listeners with handler.
+type fcgiServer struct {
+	handler      http.Handler
+	maxBodyBytes int64 // stdin a request may send, it is aborted beyond, 0 no limit
+	mu           sync.Mutex
+	listeners    map[net.Listener]struct{}
+	conns        map[*fcgiConn]struct{}
+	shuttingDown bool
+}
+
+func newFcgiServer(handler http.Handler) *fcgiServer {
+	return &fcgiServer{
+		handler:   handler,
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[*fcgiConn]struct{}{},
+	}
+}
+
+// Serve accepts the connections of l until it is closed, after Shutdown or
+// Close it returns http.ErrServerClosed.
+func (fs *fcgiServer) Serve(l net.Listener) error {
+	fs.mu.Lock()
+	if fs.shuttingDown {
+		fs.mu.Unlock()
+		return http.ErrServerClosed
+	}
+	fs.listeners[l] = struct{}{}
+	fs.mu.Unlock()
+	defer func() {
+		fs.mu.Lock()
+		delete(fs.listeners, l)
+		fs.mu.Unlock()
+	}()
+	for {
+		rw, err := l.Accept()
+		if err != nil {
+			if fs.isShuttingDown() {
+				return http.ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		conn := &fcgiConn{server: fs, rwc: rw, requests: map[uint16]*fcgiRequest{}}
+		fs.mu.Lock()
+		fs.conns[conn] = struct{}{}
+		fs.mu.Unlock()
+		go conn.serve()
+	}
+}
+
+func (fs *fcgiServer) isShuttingDown() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.shuttingDown
+}
+
+func (fs *fcgiServer) closeListeners() {
+	fs.shuttingDown = true
+	for l := range fs.listeners {
+		l.Close()
+	}
+}
+
+// Shutdown closes the listeners and the idle connections, and waits until
+// the requests being served are finished or ctx is done.
+func (fs *fcgiServer) Shutdown(ctx context.Context) error {
+	fs.mu.Lock()
+	fs.closeListeners()
+	fs.mu.Unlock()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		fs.mu.Lock()
+		for conn := range fs.conns {
+			if conn.idle() {
+				conn.rwc.Close()
+			}
+		}
+		left := len(fs.conns)
+		fs.mu.Unlock()
+		if left == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close closes the listeners and every connection.
+func (fs *fcgiServer) Close() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.closeListeners()
+	for conn := range fs.conns {
+		conn.rwc.Close()
+	}
+}
+
+// fcgiConn is a connection from the web server, it may carry several
+// requests at once.
+type fcgiConn struct {
+	server   *fcgiServer
+	rwc      net.Conn
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	requests map[uint16]*fcgiRequest
+}
+
+type fcgiRequest struct {
+	id        uint16
+	keepConn  bool
+	params    map[string]string
+	rawParams []byte
+	body      *fcgiBody
+	bodyBytes int64 // stdin received
+	started   bool
+	aborted   int32 // the response is dropped, the request ends with an error status
+}
+
+// abort ends the body with err and drops the rest of the response, the web
+// server must not take what was already sent for a whole response.
+func (req *fcgiRequest) abort(err error) {
+	atomic.StoreInt32(&req.aborted, 1)
+	if req.body != nil {
+		req.body.closeWithError(err)
+	}
+}
+
+func (req *fcgiRequest) isAborted() bool {
+	return atomic.LoadInt32(&req.aborted) != 0
+}
+
+func (c *fcgiConn) idle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.requests) == 0
+}
+
+func (c *fcgiConn) serve() {
+	defer func() {
+		c.rwc.Close()
+		c.mu.Lock()
+		for _, req := range c.requests {
+			if req.body != nil {
+				req.body.closeWithError(io.ErrUnexpectedEOF)
+			}
+		}
+		c.mu.Unlock()
+		c.server.mu.Lock()
+		delete(c.server.conns, c)
+		c.server.mu.Unlock()
+	}()
+	reader := bufio.NewReader(c.rwc)
+	content := make([]byte, fcgiMaxWrite+255)
+	for {
+		var header fcgiHeader
+		if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+			return
+		}
+		if header.Version != fcgiVersion {
+			lemonLag.Warning(fmt.Sprintf("FastCGI: unsupported version %d", header.Version))
+			return
+		}
+		n := int(header.ContentLength) + int(header.PaddingLength)
+		if _, err := io.ReadFull(reader, content[:n]); err != nil {
+			return
+		}
+		if !c.handleRecord(header, content[:header.ContentLength]) {
+			return
+		}
+	}
+}
+
+// handleRecord handles a record read from the web server, it returns false
+// if the connection must be closed.
+func (c *fcgiConn) handleRecord(header fcgiHeader, content []byte) bool {
+	if header.Type == fcgiGetValues {
+		values := map[string]string{"FCGI_MPXS_CONNS": "1"}
+		c.writeRecord(fcgiGetValuesResult, 0, encodeFcgiParams(values))
+		return true
+	}
+	c.mu.Lock()
+	req, ok := c.requests[header.Id]
+	c.mu.Unlock()
+	switch header.Type {
+	case fcgiBeginRequest:
+		if ok || len(content) < 8 {
+			return false
+		}
+		role := binary.BigEndian.Uint16(content)
+		if role != fcgiResponder {
+			c.writeEndRequest(header.Id, 0, fcgiUnknownRole)
+			return true
+		}
+		c.mu.Lock()
+		c.requests[header.Id] = &fcgiRequest{id: header.Id, keepConn: content[2]&fcgiKeepConn != 0}
+		c.mu.Unlock()
+	case fcgiParams:
+		if !ok || req.started {
+			return true
+		}
+		if len(content) > 0 {
+			req.rawParams = append(req.rawParams, content...)
+			return true
+		}
+		params, err := decodeFcgiParams(req.rawParams)
+		if err != nil {
+			lemonLag.Warning(fmt.Sprintf("FastCGI: %v", err))
+			return false
+		}
+		req.params, req.rawParams = params, nil
+		req.body = newFcgiBody()
+		req.started = true
+		go c.serveRequest(req)
+	case fcgiStdin:
+		if !ok || req.body == nil {
+			return true
+		}
+		if len(content) == 0 {
+			req.body.closeWithError(io.EOF)
+			return true
+		}
+		req.bodyBytes += int64(len(content))
+		if max := c.server.maxBodyBytes; max > 0 && req.bodyBytes > max {
+			// the rest of stdin is discarded by the closed body
+			req.abort(&http.MaxBytesError{Limit: max})
+			return true
+		}
+		req.body.write(content)
+	case fcgiAbortRequest:
+		if !ok {
+			return true
+		}
+		req.abort(errFcgiAborted)
+		if !req.started {
+			c.endRequest(req)
+		}
+	case fcgiData:
+	default:
+		body := make([]byte, 8)
+		body[0] = header.Type
+		c.writeRecord(fcgiUnknownType, 0, body)
+	}
+	return true
+}
+
+func (c *fcgiConn) serveRequest(req *fcgiRequest) {
+	w := &fcgiResponseWriter{conn: c, req: req, header: http.Header{}}
+	w.w = bufio.NewWriterSize(&fcgiStreamWriter{conn: c, id: req.id, recordType: fcgiStdout}, fcgiMaxWrite)
+	r, err := cgi.RequestFromMap(req.params)
+	if err != nil {
+		lemonLag.Error(fmt.Sprintf("FastCGI: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		r.Body = req.body
+		r = r.WithContext(context.WithValue(r.Context(), fcgiParamsKey{}, req.params))
+		c.callHandler(w, r)
+	}
+	if !req.isAborted() {
+		w.finish()
+	}
+	req.body.Close()
+	c.endRequest(req)
+}
+
+// fcgiBody is the body of a request. The stdin records are buffered, so
+// the connection is read on, for its other requests and their aborts, while
+// the handler does not read the body.
+type fcgiBody struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	buffer bytes.Buffer
+	err    error // io.EOF once stdin ends
+	closed bool  // the handler is finished, the records are discarded
+}
+
+func newFcgiBody() *fcgiBody {
+	body := &fcgiBody{}
+	body.cond.L = &body.mu
+	return body
+}
+
+// write adds the content of a stdin record.
+func (b *fcgiBody) write(content []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || b.err != nil {
+		return
+	}
+	b.buffer.Write(content)
+	b.cond.Signal()
+}
+
+// closeWithError ends the body, Read returns err once the content is read.
+func (b *fcgiBody) closeWithError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+}
+
+func (b *fcgiBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buffer.Len() == 0 && b.err == nil && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if b.buffer.Len() != 0 {
+		return b.buffer.Read(p)
+	}
+	return 0, b.err
+}
+
+func (b *fcgiBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.buffer = bytes.Buffer{}
+	b.cond.Broadcast()
+	return nil
+}
+
+// callHandler serves r, a panic gives an error page, or aborts the request
+// once the response is started. Like net/http, http.ErrAbortHandler aborts
+// it without a log.
+func (c *fcgiConn) callHandler(w *fcgiResponseWriter, r *http.Request) {
+	defer func() {
+		if err := recover(); err != nil {
+			if err != http.ErrAbortHandler {
+				lemonLag.Error(fmt.Sprintf("FastCGI handler: %v", err))
+			}
+			if err == http.ErrAbortHandler || w.wroteHeader {
+				w.req.abort(errFcgiAborted)
+				return
+			}
+			w.header = http.Header{}
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+	c.server.handler.ServeHTTP(w, r)
+}
+
+// endRequest ends req, with the application status 1 if it was aborted.
+func (c *fcgiConn) endRequest(req *fcgiRequest) {
+	var appStatus uint32
+	if req.isAborted() {
+		appStatus = 1
+	}
+	c.writeEndRequest(req.id, appStatus, fcgiComplete)
+	c.mu.Lock()
+	delete(c.requests, req.id)
+	c.mu.Unlock()
+	if !req.keepConn || c.server.isShuttingDown() && c.idle() {
+		c.rwc.Close()
+	}
+}
+
+func (c *fcgiConn) writeEndRequest(id uint16, appStatus uint32, protocolStatus uint8) {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint32(body, appStatus)
+	body[4] = protocolStatus
+	c.writeRecord(fcgiEndRequest, id, body)
+}
+
+func (c *fcgiConn) writeRecord(recordType uint8, id uint16, content []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	padding := -len(content) & 7
+	header := fcgiHeader{
+		Version:       fcgiVersion,
+		Type:          recordType,
+		Id:            id,
+		ContentLength: uint16(len(content)),
+		PaddingLength: uint8(padding),
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 8+len(content)+padding))
+	binary.Write(buf, binary.BigEndian, header)
+	buf.Write(content)
+	buf.Write(make([]byte, padding))
+	_, err := c.rwc.Write(buf.Bytes())
+	return err
+}
+
+// fcgiStreamWriter writes a stream as records of at most fcgiMaxWrite bytes.
+type fcgiStreamWriter struct {
+	conn       *fcgiConn
+	id         uint16
+	recordType uint8
+}
+
+func (sw *fcgiStreamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > fcgiMaxWrite {
+			n = fcgiMaxWrite
+		}
+		if err := sw.conn.writeRecord(sw.recordType, sw.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// fcgiResponseWriter writes the response as a CGI response to stdout.
+type fcgiResponseWriter struct {
+	conn        *fcgiConn
+	req         *fcgiRequest
+	header      http.Header
+	w           *bufio.Writer
+	wroteHeader bool
+}
+
+func (w *fcgiResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *fcgiResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code == http.StatusNotModified {
+		w.header.Del("Content-Type")
+		w.header.Del("Content-Length")
+		w.header.Del("Transfer-Encoding")
+	}
+	if len(w.header.Get("Date")) == 0 {
+		w.header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	fmt.Fprintf(w.w, "Status: %d %s\r\n", code, http.StatusText(code))
+	w.header.Write(w.w)
+	w.w.WriteString("\r\n")
+}
+
+func (w *fcgiResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if len(w.header.Get("Content-Type")) == 0 {
+			w.header.Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.req.isAborted() {
+		return 0, errFcgiAborted
+	}
+	return w.w.Write(p)
+}
+
+func (w *fcgiResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.req.isAborted() {
+		w.w.Flush()
+	}
+}
+
+// finish flushes the response and ends the stdout stream.
+func (w *fcgiResponseWriter) finish() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.w.Flush()
+	w.conn.writeRecord(fcgiStdout, w.req.id, nil)
+}
+
+func decodeFcgiParams(data []byte) (map[string]string, error) {
+	params := map[string]string{}
+	for len(data) > 0 {
+		nameLength, n := decodeFcgiLength(data)
+		if n == 0 {
+			return nil, errors.New("invalid params")
+		}
+		data = data[n:]
+		valueLength, n := decodeFcgiLength(data)
+		if n == 0 || uint64(len(data)-n) < uint64(nameLength)+uint64(valueLength) {
+			return nil, errors.New("invalid params")
+		}
+		data = data[n:]
+		params[string(data[:nameLength])] = string(data[nameLength : nameLength+valueLength])
+		data = data[nameLength+valueLength:]
+	}
+	return params, nil
+}
+
+func decodeFcgiLength(data []byte) (uint32, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	if data[0]>>7 == 0 {
+		return uint32(data[0]), 1
+	}
+	if len(data) < 4 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint32(data) &^ (1 << 31), 4
+}
+
+func encodeFcgiParams(params map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	for name, value := range params {
+		encodeFcgiLength(buf, len(name))
+		encodeFcgiLength(buf, len(value))
+		buf.WriteString(name)
+		buf.WriteString(value)
+	}
+	return buf.Bytes()
+}
+
+func encodeFcgiLength(buf *bytes.Buffer, length int) {
+	if length <= 127 {
+		buf.WriteByte(byte(length))
+		return
+	}
+	binary.Write(buf, binary.BigEndian, uint32(length)|1<<31)
+}
+
+// fastCGIPath returns the path prefix the application is mounted on and
+// the path within the application from the FastCGI params, PATH_INFO must
+// be set for SCRIPT_NAME to be taken as the prefix: the web servers set
+// SCRIPT_NAME to the whole path when they don't split it.
+func fastCGIPath(params map[string]string) (string, string, bool) {
+	pathInfo, ok := params["PATH_INFO"]
+	if !ok {
+		return "", "", false
+	}
+	if !strings.HasPrefix(pathInfo, "/") {
+		pathInfo = "/" + pathInfo
+	}
+	return strings.TrimRight(params["SCRIPT_NAME"], "/"), pathInfo, true
+}
@@ -0,0 +1,312 @@
+package lemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fcgiClient is a minimal FastCGI client, the web server side of a
+// connection.
+type fcgiClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// fcgiResponse is what the application wrote for a request.
+type fcgiResponse struct {
+	stdout      bytes.Buffer
+	stdoutEnded bool // an empty stdout record was sent
+	appStatus   uint32
+	ended       bool
+}
+
+func dialFcgi(t *testing.T, network, address string) *fcgiClient {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &fcgiClient{t: t, conn: conn}
+}
+
+func (c *fcgiClient) writeRecord(recordType uint8, id uint16, content []byte) {
+	header := fcgiHeader{Version: fcgiVersion, Type: recordType, Id: id, ContentLength: uint16(len(content))}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, header)
+	buf.Write(content)
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// begin starts the request id with params, the connection is kept after it.
+func (c *fcgiClient) begin(id uint16, params map[string]string) {
+	c.writeRecord(fcgiBeginRequest, id, []byte{0, fcgiResponder, fcgiKeepConn, 0, 0, 0, 0, 0})
+	c.writeRecord(fcgiParams, id, encodeFcgiParams(params))
+	c.writeRecord(fcgiParams, id, nil)
+}
+
+// stdin sends body, the request is complete if end is set.
+func (c *fcgiClient) stdin(id uint16, body []byte, end bool) {
+	for len(body) > 0 {
+		n := len(body)
+		if n > fcgiMaxWrite {
+			n = fcgiMaxWrite
+		}
+		c.writeRecord(fcgiStdin, id, body[:n])
+		body = body[n:]
+	}
+	if end {
+		c.writeRecord(fcgiStdin, id, nil)
+	}
+}
+
+// read reads the records until the requests ids are ended.
+func (c *fcgiClient) read(ids ...uint16) map[uint16]*fcgiResponse {
+	responses := map[uint16]*fcgiResponse{}
+	for _, id := range ids {
+		responses[id] = &fcgiResponse{}
+	}
+	reader := bufio.NewReader(c.conn)
+	for left := len(ids); left > 0; {
+		var header fcgiHeader
+		if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+			c.t.Fatalf("reading the response: %v", err)
+		}
+		content := make([]byte, int(header.ContentLength)+int(header.PaddingLength))
+		if _, err := io.ReadFull(reader, content); err != nil {
+			c.t.Fatalf("reading the response: %v", err)
+		}
+		content = content[:header.ContentLength]
+		response, ok := responses[header.Id]
+		if !ok || response.ended {
+			c.t.Fatalf("record %d of request %d", header.Type, header.Id)
+		}
+		switch header.Type {
+		case fcgiStdout:
+			response.stdout.Write(content)
+			response.stdoutEnded = len(content) == 0
+		case fcgiEndRequest:
+			response.appStatus = binary.BigEndian.Uint32(content)
+			response.ended = true
+			left--
+		}
+	}
+	return responses
+}
+
+// do sends a request and returns its CGI response.
+func (c *fcgiClient) do(params map[string]string, body string) (int, http.Header, string) {
+	c.begin(1, params)
+	c.stdin(1, []byte(body), true)
+	return parseCgiResponse(c.t, c.read(1)[1].stdout.Bytes())
+}
+
+func parseCgiResponse(t *testing.T, stdout []byte) (int, http.Header, string) {
+	header, body, ok := strings.Cut(string(stdout), "\r\n\r\n")
+	if !ok {
+		t.Fatalf("malformed CGI response %q", stdout)
+	}
+	h := http.Header{}
+	for _, line := range strings.Split(header, "\r\n") {
+		key, value, _ := strings.Cut(line, ": ")
+		h.Add(key, value)
+	}
+	var status int
+	fmt.Sscanf(h.Get("Status"), "%d", &status)
+	return status, h, body
+}
+
+func fcgiParamsOf(method, scriptName, pathInfo, query string) map[string]string {
+	uri := scriptName + pathInfo
+	if len(query) != 0 {
+		uri += "?" + query
+	}
+	return map[string]string{
+		"REQUEST_METHOD":  method,
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"HTTP_HOST":       "localhost",
+		"REMOTE_ADDR":     "127.0.0.1",
+		"REMOTE_PORT":     "40000",
+		"SCRIPT_NAME":     scriptName,
+		"PATH_INFO":       pathInfo,
+		"QUERY_STRING":    query,
+		"REQUEST_URI":     uri,
+	}
+}
+
+type fcgiItemHandler struct {
+	RequestHandler
+}
+
+func (h *fcgiItemHandler) Get(args ...string) {
+	h.Write([]byte(args[0] + " " + h.ReverseUrl("item", args[0]) + " " + h.application.ReverseUrl("item", args[0])))
+}
+
+func (h *fcgiItemHandler) Post(args ...string) {
+	h.Write([]byte(args[0] + " " + h.GetQueryArgument("name") + " " + string(h.Request.Body())))
+}
+
+func TestFcgiServer(t *testing.T) {
+	app := NewApplication()
+	app.Init([]UrlSpec{AddRouter("/items/(\\w+)", &fcgiItemHandler{}, nil, "item")},
+		map[string]interface{}{"CookieSecret": "secret", "DefaultHost": "localhost"})
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			address := "127.0.0.1:0"
+			if network == "unix" {
+				address = filepath.Join(t.TempDir(), "fcgi.sock")
+			}
+			l, err := net.Listen(network, address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := newFcgiServer(app)
+			go server.Serve(l)
+			defer server.Close()
+			c := dialFcgi(t, network, l.Addr().String())
+			defer c.conn.Close()
+
+			status, _, body := c.do(fcgiParamsOf("GET", "/app", "/items/42", ""), "")
+			if status != 200 || body != "42 /app/items/42 /items/42" {
+				t.Errorf("GET under /app: %d %q", status, body)
+			}
+			status, _, body = c.do(fcgiParamsOf("GET", "/app/items/7", "", ""), "")
+			if status != 404 {
+				t.Errorf("SCRIPT_NAME without PATH_INFO: %d %q", status, body)
+			}
+			params := fcgiParamsOf("POST", "/app", "/items/42", "name=bob")
+			params["CONTENT_TYPE"] = "text/plain"
+			params["CONTENT_LENGTH"] = "11"
+			status, _, body = c.do(params, "hello world")
+			if status != 200 || body != "42 bob hello world" {
+				t.Errorf("POST under /app: %d %q", status, body)
+			}
+		})
+	}
+	app.ScriptName = "/mnt"
+	if url := app.ReverseUrl("item", "1"); url != "/mnt/items/1" {
+		t.Errorf("ReverseUrl with ScriptName: %q", url)
+	}
+}
+
+// TestFcgiServerBodyNotRead checks a request whose handler does not read
+// its body does not stop the other requests of the connection.
+func TestFcgiServerBodyNotRead(t *testing.T) {
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wait", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "waited")
+	})
+	mux.HandleFunc("/release", func(w http.ResponseWriter, r *http.Request) {
+		close(release)
+		io.WriteString(w, "released")
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newFcgiServer(mux)
+	go server.Serve(l)
+	defer server.Close()
+	c := dialFcgi(t, "tcp", l.Addr().String())
+	defer c.conn.Close()
+	params := fcgiParamsOf("POST", "", "/wait", "")
+	params["CONTENT_LENGTH"] = "200000"
+	c.begin(1, params)
+	c.stdin(1, bytes.Repeat([]byte("x"), 200000), true)
+	c.begin(2, fcgiParamsOf("GET", "", "/release", ""))
+	c.stdin(2, nil, true)
+	responses := c.read(1, 2)
+	for id, want := range map[uint16]string{1: "waited", 2: "released"} {
+		status, _, body := parseCgiResponse(t, responses[id].stdout.Bytes())
+		if status != 200 || body != want {
+			t.Errorf("request %d: %d %q", id, status, body)
+		}
+	}
+}
+
+// TestFcgiServerAbort checks a request is aborted, without the end of its
+// stdout and with an error status, once its body is too large or its handler
+// panics after the response started, and the connection serves on.
+func TestFcgiServerAbort(t *testing.T) {
+	bodyErr := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		bodyErr <- err
+		io.WriteString(w, "uploaded")
+	})
+	mux.HandleFunc("/abort", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	})
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		panic("render failed")
+	})
+	mux.HandleFunc("/panic-early", func(w http.ResponseWriter, r *http.Request) {
+		panic("no response yet")
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newFcgiServer(mux)
+	server.maxBodyBytes = 1000
+	go server.Serve(l)
+	defer server.Close()
+	c := dialFcgi(t, "tcp", l.Addr().String())
+	defer c.conn.Close()
+
+	params := fcgiParamsOf("POST", "", "/upload", "")
+	params["CONTENT_LENGTH"] = "5000"
+	c.begin(1, params)
+	c.stdin(1, bytes.Repeat([]byte("x"), 5000), true)
+	response := c.read(1)[1]
+	if response.appStatus == 0 || response.stdoutEnded {
+		t.Errorf("body too large: status %d, stdout ended %v", response.appStatus, response.stdoutEnded)
+	}
+	var maxBytesErr *http.MaxBytesError
+	if err := <-bodyErr; !errors.As(err, &maxBytesErr) || maxBytesErr.Limit != 1000 {
+		t.Errorf("reading the body too large: %v", err)
+	}
+
+	for _, path := range []string{"/abort", "/panic"} {
+		c.begin(1, fcgiParamsOf("GET", "", path, ""))
+		c.stdin(1, nil, true)
+		response := c.read(1)[1]
+		if response.appStatus == 0 || response.stdoutEnded {
+			t.Errorf("%s: status %d, stdout ended %v", path, response.appStatus, response.stdoutEnded)
+		}
+	}
+
+	c.begin(1, fcgiParamsOf("GET", "", "/panic-early", ""))
+	c.stdin(1, nil, true)
+	response = c.read(1)[1]
+	if status, _, _ := parseCgiResponse(t, response.stdout.Bytes()); status != 500 || response.appStatus != 0 || !response.stdoutEnded {
+		t.Errorf("panic before the response: %d, status %d, stdout ended %v", status, response.appStatus, response.stdoutEnded)
+	}
+
+	params = fcgiParamsOf("POST", "", "/ok", "")
+	params["CONTENT_LENGTH"] = "1000"
+	if status, _, body := c.do(params, strings.Repeat("y", 1000)); status != 200 || len(body) != 1000 {
+		t.Errorf("body of the limit: %d %d bytes", status, len(body))
+	}
+}
@@ -0,0 +1,268 @@
+package lemon
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// initTrustedProxies parses the networks of TrustedProxies and checks
+// ProxyHeader.
+func (app *Application) initTrustedProxies() {
+	app.ProxyHeader = http.CanonicalHeaderKey(app.ProxyHeader)
+	switch app.ProxyHeader {
+	case "":
+		app.ProxyHeader = "X-Forwarded-For"
+	case "X-Forwarded-For", "X-Real-Ip", "Forwarded":
+	default:
+		errLog := fmt.Sprintf("invalid ProxyHeader %s, must be X-Forwarded-For, X-Real-Ip or Forwarded", app.ProxyHeader)
+		lemonLag.Error(errLog)
+		panic(errLog)
+	}
+	app.trustedProxies = nil
+	for _, cidr := range app.TrustedProxies {
+		network, err := parseNetwork(cidr)
+		if err != nil {
+			errLog := fmt.Sprintf("invalid TrustedProxies network %s: %v", cidr, err)
+			lemonLag.Error(errLog)
+			panic(errLog)
+		}
+		app.trustedProxies = append(app.trustedProxies, network)
+	}
+}
+
+// forwardedHop is what a proxy tells about the request it received, an
+// element of the Forwarded header or an entry of X-Forwarded-For.
+type forwardedHop struct {
+	ip     string // the address of the client or proxy it received the request from
+	scheme string
+	host   string
+}
+
+// forwardedRequest is the client address, scheme and host of a request,
+// taken from the proxy headers sent by the trusted proxies.
+type forwardedRequest struct {
+	ip     string
+	scheme string
+	host   string
+}
+
+// forwarded resolves the client of the request once. Starting from the
+// peer of the connection, it walks the hops of the ProxyHeader right to
+// left while the address reached is a trusted proxy. The scheme and host
+// are the ones given by the last hops taken, so the address, scheme and
+// host all come from the same proxies.
+func (hr *HttpRequest) forwarded() *forwardedRequest {
+	if hr.client != nil {
+		return hr.client
+	}
+	scheme := "http"
+	if hr.Request.TLS != nil {
+		scheme = "https"
+	}
+	if hr.Request.URL.Scheme != "" {
+		scheme = hr.Request.URL.Scheme
+	}
+	result := &forwardedRequest{ip: addrIP(hr.Request.RemoteAddr), scheme: scheme, host: hr.Request.Host}
+	hr.client = result
+	trusted := hr.trustsProxy(result.ip)
+	if net.ParseIP(result.ip) == nil {
+		// a unix socket, the proxy is a local process
+		result.ip = "127.0.0.1"
+		trusted = len(hr.trustedProxies) != 0 || hr.Xheaders
+	}
+	if !trusted {
+		return result
+	}
+	hops := hr.forwardedHops()
+	for i := len(hops) - 1; i >= 0 && trusted; i-- {
+		hop := hops[i]
+		if net.ParseIP(hop.ip) == nil {
+			// "unknown" or an obfuscated identifier, the client is hidden
+			break
+		}
+		result.ip = hop.ip
+		if hop.scheme == "http" || hop.scheme == "https" {
+			result.scheme = hop.scheme
+		}
+		if len(hop.host) != 0 {
+			result.host = hop.host
+		}
+		// without TrustedProxies only the peer is known to be a proxy, the
+		// hops on its left may be written by the client
+		trusted = len(hr.trustedProxies) != 0 && hr.trustsProxy(hop.ip)
+	}
+	return result
+}
+
+// trustsProxy reports whether the proxy headers sent by ip are believed.
+// Without TrustedProxies the peer of the connection is trusted if Xheaders
+// is on.
+func (hr *HttpRequest) trustsProxy(ip string) bool {
+	if len(hr.trustedProxies) == 0 {
+		return hr.Xheaders
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range hr.trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHops returns the hops of the header written by the proxies,
+// ProxyHeader: the Forwarded header, or X-Forwarded-For or X-Real-Ip with
+// X-Forwarded-Proto or X-Scheme, X-Forwarded-Host and X-Forwarded-Port.
+// The other one is ignored, the client may have sent it.
+func (hr *HttpRequest) forwardedHops() []forwardedHop {
+	var ips []string
+	switch hr.proxyHeader {
+	case "Forwarded":
+		return parseForwarded(strings.Join(hr.Request.Header.Values("Forwarded"), ","))
+	case "X-Real-Ip":
+		if realIP := hr.Header("X-Real-Ip"); len(realIP) != 0 {
+			ips = []string{realIP}
+		}
+	default:
+		ips = hr.Proxy()
+	}
+	if len(ips) == 0 {
+		return nil
+	}
+	schemes := splitHeader(hr.Header("X-Forwarded-Proto"))
+	if len(schemes) == 0 {
+		schemes = splitHeader(hr.Header("X-Scheme"))
+	}
+	hosts := splitHeader(hr.Header("X-Forwarded-Host"))
+	ports := splitHeader(hr.Header("X-Forwarded-Port"))
+	hops := make([]forwardedHop, len(ips))
+	for i, ip := range ips {
+		hops[i] = forwardedHop{
+			ip:     addrIP(strings.TrimSpace(ip)),
+			scheme: strings.ToLower(alignedValue(schemes, i, len(ips))),
+			host:   alignedValue(hosts, i, len(ips)),
+		}
+		if port := alignedValue(ports, i, len(ips)); len(port) != 0 {
+			host := hops[i].host
+			if len(host) == 0 {
+				host = hr.Request.Host
+			}
+			hops[i].host = net.JoinHostPort(strings.Trim(hostName(host), "[]"), port)
+		}
+	}
+	return hops
+}
+
+// alignedValue returns the value of the hop i among count hops. A list as
+// long as X-Forwarded-For has a value per hop, otherwise the values are
+// taken as the ones of the client.
+func alignedValue(values []string, i, count int) string {
+	if len(values) == count {
+		return values[i]
+	}
+	if len(values) != 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func splitHeader(value string) []string {
+	if len(value) == 0 {
+		return nil
+	}
+	values := strings.Split(value, ",")
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return values
+}
+
+// parseForwarded parses an RFC 7239 Forwarded header,
+//
+//	Forwarded: for=192.0.2.60;proto=https;host=example.com, for="[2001:db8::1]:4711"
+//
+// An element which cannot be parsed is kept with an empty address, so the
+// walk stops there.
+func parseForwarded(header string) []forwardedHop {
+	hops := []forwardedHop{}
+	for _, element := range splitQuoted(header, ',') {
+		if len(strings.TrimSpace(element)) == 0 {
+			continue
+		}
+		hop := forwardedHop{}
+		for _, pair := range splitQuoted(element, ';') {
+			i := strings.Index(pair, "=")
+			if i < 0 {
+				hop = forwardedHop{}
+				break
+			}
+			name := strings.ToLower(strings.TrimSpace(pair[:i]))
+			value := strings.TrimSpace(pair[i+1:])
+			if unquoted, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+				value = unquoted
+			}
+			switch name {
+			case "for":
+				hop.ip = addrIP(value)
+			case "proto":
+				hop.scheme = strings.ToLower(value)
+			case "host":
+				hop.host = value
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// splitQuoted splits s on sep outside of the quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	parts := []string{}
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\' && quoted:
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// addrIP returns the IP address of "ip", "ip:port", "[ipv6]" or
+// "[ipv6]:port", addr itself if it is none of them.
+func addrIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if i := strings.Index(addr, "%"); i >= 0 && net.ParseIP(addr[:i]) != nil {
+		// keeps the zone of a link local address out
+		addr = addr[:i]
+	}
+	return addr
+}
+
+// hostName returns host without its port, IPv6 addresses keep their
+// brackets.
+func hostName(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		if strings.Contains(name, ":") {
+			return "[" + name + "]"
+		}
+		return name
+	}
+	return host
+}
@@ -0,0 +1,62 @@
+package lemon
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		name        string
+		xheaders    bool
+		trusted     []string
+		proxyHeader string
+		peer        string
+		headers     map[string]string
+		ip          string
+		scheme      string
+	}{
+		{"no proxy", false, nil, "", "203.0.113.9:1234",
+			map[string]string{"X-Forwarded-For": "6.6.6.6"}, "203.0.113.9", "http"},
+		{"Xheaders trusts the peer only", true, nil, "", "10.0.0.2:1234",
+			map[string]string{"X-Forwarded-For": "6.6.6.6, 203.0.113.9", "X-Forwarded-Proto": "http, https"}, "203.0.113.9", "https"},
+		{"trusted proxies", false, []string{"10.0.0.0/8"}, "", "10.0.0.2:1234",
+			map[string]string{"X-Forwarded-For": "6.6.6.6, 203.0.113.9, 10.1.1.1"}, "203.0.113.9", "http"},
+		{"untrusted peer", false, []string{"10.0.0.0/8"}, "", "192.0.2.1:1234",
+			map[string]string{"X-Forwarded-For": "6.6.6.6"}, "192.0.2.1", "http"},
+		{"forged Forwarded", true, nil, "", "10.0.0.2:1234",
+			map[string]string{"Forwarded": "for=6.6.6.6;proto=https", "X-Forwarded-For": "203.0.113.9"}, "203.0.113.9", "http"},
+		{"Forwarded", false, []string{"10.0.0.0/8"}, "Forwarded", "10.0.0.2:1234",
+			map[string]string{"Forwarded": `for=6.6.6.6, for="[2001:db8::1]:4711";proto=https`, "X-Forwarded-For": "6.6.6.6"}, "2001:db8::1", "https"},
+		{"forged X-Forwarded-For", true, nil, "Forwarded", "10.0.0.2:1234",
+			map[string]string{"X-Forwarded-For": "6.6.6.6"}, "10.0.0.2", "http"},
+		{"X-Real-Ip", true, nil, "X-Real-Ip", "10.0.0.2:1234",
+			map[string]string{"X-Real-Ip": "203.0.113.9", "X-Forwarded-For": "6.6.6.6"}, "203.0.113.9", "http"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.peer
+		for key, value := range test.headers {
+			r.Header.Set(key, value)
+		}
+		request := NewHttpRequest(r, test.xheaders, 1<<20)
+		request.proxyHeader = test.proxyHeader
+		for _, cidr := range test.trusted {
+			_, network, _ := net.ParseCIDR(cidr)
+			request.trustedProxies = append(request.trustedProxies, network)
+		}
+		if ip, scheme := request.RemoteIP(), request.Scheme(); ip != test.ip || scheme != test.scheme {
+			t.Errorf("%s: %s %s, want %s %s", test.name, ip, scheme, test.ip, test.scheme)
+		}
+	}
+}
+
+func TestInvalidProxyHeader(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Init accepted an invalid ProxyHeader")
+		}
+	}()
+	NewApplication().Init(nil, map[string]interface{}{"CookieSecret": "secret", "ProxyHeader": "X-Client-Ip"})
+}
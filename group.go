@@ -0,0 +1,76 @@
+package lemon
+
+import (
+	"strings"
+)
+
+// RouteGroup adds routes sharing a path prefix, a host pattern, Initialize
+// kwargs, a name prefix and middlewares to an Application. Groups nest: a
+// sub group appends its own prefix, kwargs, name prefix and middlewares to
+// those of its parent.
+//
+//	admin := app.Group("", "/admin", lemon.Dictionary{"db": db}, "admin.", requireAdmin)
+//	admin.AddRouter("/users/{id:int}", &UserHandler{}, lemon.NullDictionary(), "user")
+//	app.ReverseUrlKwargs("admin.user", lemon.Dictionary{"id": 1}) // "/admin/users/1"
+type RouteGroup struct {
+	app         *Application
+	hostPattern string
+	prefix      string
+	kwargs      Dictionary
+	namePrefix  string
+	middlewares []Middleware
+}
+
+// Group returns a RouteGroup whose routes are served for hostPattern, the
+// routes of every host when hostPattern is empty.
+//
+// Routes are added after the ones given to Init, also when the group is
+// created before Init, so a catch-all route of Init hides the routes of the
+// groups.
+func (app *Application) Group(hostPattern, prefix string, kwargs Dictionary,
+	namePrefix string, middlewares ...Middleware) *RouteGroup {
+	if hostPattern == "" {
+		hostPattern = ".*$"
+	}
+	group := &RouteGroup{app: app, hostPattern: hostPattern, kwargs: NullDictionary()}
+	return group.Group(prefix, kwargs, namePrefix, middlewares...)
+}
+
+// Group returns a sub group of group.
+func (group *RouteGroup) Group(prefix string, kwargs Dictionary,
+	namePrefix string, middlewares ...Middleware) *RouteGroup {
+	return &RouteGroup{
+		app:         group.app,
+		hostPattern: group.hostPattern,
+		prefix:      group.prefix + strings.TrimSuffix(prefix, "/"),
+		kwargs:      mergeDictionary(group.kwargs, kwargs),
+		namePrefix:  group.namePrefix + namePrefix,
+		middlewares: append(append([]Middleware{}, group.middlewares...), middlewares...),
+	}
+}
+
+// AddRouter adds a route to the application like `AddRouter`, the pattern
+// is appended to the prefix of the group, params to its kwargs, name to
+// its name prefix and middlewares to its middlewares.
+func (group *RouteGroup) AddRouter(pattern string, handler HandlerInterface,
+	params Dictionary, name string, middlewares ...Middleware) UrlSpec {
+	pattern = group.prefix + strings.TrimPrefix(pattern, "^")
+	if len(name) != 0 {
+		name = group.namePrefix + name
+	}
+	spec := NewUrlSpec(pattern, handler, name, mergeDictionary(group.kwargs, params))
+	spec.middlewares = append(append([]Middleware{}, group.middlewares...), middlewares...)
+	group.app.addUrlSpec(group.hostPattern, spec)
+	return spec
+}
+
+func mergeDictionary(base, extra Dictionary) Dictionary {
+	merged := NullDictionary()
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range extra {
+		merged[key] = value
+	}
+	return merged
+}
@@ -0,0 +1,82 @@
+package lemon
+
+import (
+	"strings"
+	"testing"
+)
+
+type kwargsHandler struct {
+	RequestHandler
+	kwargs Dictionary
+}
+
+func (h *kwargsHandler) Initialize(params Dictionary) {
+	h.kwargs = params
+}
+
+func (h *kwargsHandler) Get(args ...string) {
+	h.Write([]byte(h.kwargs["db"].(string) + " " + h.kwargs["area"].(string) + " " + strings.Join(args, ",")))
+}
+
+// tagMiddleware appends tag to the "tags" header of the response.
+func tagMiddleware(tag string) Middleware {
+	return func(ctx *RouteContext, next func()) {
+		ctx.ResponseWriter.Header().Add("tags", tag)
+		next()
+	}
+}
+
+func TestRouteGroups(t *testing.T) {
+	for _, beforeInit := range []bool{false, true} {
+		app := NewApplication()
+		addGroups := func() {
+			admin := app.Group("", "/admin/", Dictionary{"db": "main", "area": "admin"}, "admin.", tagMiddleware("admin"))
+			admin.AddRouter("/users/{id:int}", &kwargsHandler{}, nil, "user", tagMiddleware("user"))
+			api := admin.Group("/api", Dictionary{"area": "api"}, "api.", tagMiddleware("api"))
+			api.AddRouter("/items/([0-9]+)", &kwargsHandler{}, Dictionary{"db": "items"}, "item")
+			// hidden by the route of Init
+			admin.AddRouter("/shadowed", &kwargsHandler{}, nil, "shadowed")
+		}
+		if beforeInit {
+			addGroups()
+		}
+		app.Init([]UrlSpec{AddRouter("/admin/shadowed", &getOnlyHandler{}, nil, "init")},
+			map[string]interface{}{"CookieSecret": "secret"})
+		if !beforeInit {
+			addGroups()
+		}
+
+		tests := []struct {
+			path string
+			body string
+			tags []string
+		}{
+			{"/admin/users/3", "main admin 3", []string{"admin", "user"}},
+			{"/admin/api/items/5", "items api 5", []string{"admin", "api"}},
+			{"/admin/shadowed", "get", nil},
+		}
+		for _, test := range tests {
+			rw := serveRequest(app, "GET", test.path)
+			if rw.Code != 200 || rw.Body.String() != test.body || strings.Join(rw.Header()["Tags"], ",") != strings.Join(test.tags, ",") {
+				t.Errorf("before Init %v, %s: %d %q %v", beforeInit, test.path, rw.Code, rw.Body.String(), rw.Header()["Tags"])
+			}
+		}
+		if url := app.ReverseUrlKwargs("admin.user", Dictionary{"id": 3}); url != "/admin/users/3" {
+			t.Errorf("before Init %v, admin.user: %q", beforeInit, url)
+		}
+		if url := app.ReverseUrl("admin.api.item", "5"); url != "/admin/api/items/5" {
+			t.Errorf("before Init %v, admin.api.item: %q", beforeInit, url)
+		}
+		if url := app.ReverseUrl("init"); url != "/admin/shadowed" {
+			t.Errorf("before Init %v, init: %q", beforeInit, url)
+		}
+	}
+}
+
+func TestGroupWithoutInit(t *testing.T) {
+	app := NewApplication()
+	app.Group("", "/v1", nil, "v1.").AddRouter("/ping", &getOnlyHandler{}, nil, "ping")
+	if _, ok := app.NameHandlers["v1.ping"]; !ok {
+		t.Errorf("named routes %v", app.NameHandlers)
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 	"io"
@@ -22,6 +24,13 @@ type HttpRequest struct {
 	MaxMemory      int64
 	body []byte
 	Files          map[string][]*multipart.FileHeader // Files uploaded in a multipart form
+	PathArguments  map[string]string                  // named groups of the matched url pattern
+	PathValues     map[string]interface{}             // named groups converted by their Converter
+	ScriptName     string                             // path prefix the application is mounted on, from the FastCGI SCRIPT_NAME or Application.ScriptName
+	FastCGIParams  map[string]string                  // params of a request served by FastCGI
+	trustedProxies []*net.IPNet                       // the TrustedProxies of the Application
+	proxyHeader    string                             // the ProxyHeader of the Application
+	client         *forwardedRequest                  // address, scheme and host of the client, resolved by forwarded
 }
 
 func NewHttpRequest(req *http.Request, xhearders bool, MaxMemory int) *HttpRequest {
@@ -32,10 +41,24 @@ func NewHttpRequest(req *http.Request, xhearders bool, MaxMemory int) *HttpReque
 		startTime: time.Now(),
 		MaxMemory: maxMemory,
 	}
+	httpRequest.parseFastCGIParams()
 	httpRequest.ParseParams()
 	return &httpRequest
 }
 
+// parseFastCGIParams routes a FastCGI request by its PATH_INFO, the path
+// within the application mounted on SCRIPT_NAME.
+func (hr *HttpRequest) parseFastCGIParams() {
+	hr.FastCGIParams = FastCGIParams(hr.Request)
+	scriptName, pathInfo, ok := fastCGIPath(hr.FastCGIParams)
+	if !ok {
+		return
+	}
+	hr.ScriptName = scriptName
+	hr.Request.URL.Path = pathInfo
+	hr.Request.URL.RawPath = ""
+}
+
 func (hr *HttpRequest) ParseParams() {
 	req := hr.Request
 	hr.QueryArguments = req.URL.Query()
@@ -102,32 +125,41 @@ func (hr *HttpRequest) Uri() string {
 	return hr.Request.RequestURI
 }
 
-func (hr *HttpRequest) Scheme() string {
-	var scheme string
-	if hr.Request.URL.Scheme != "" {
-		scheme = hr.Request.URL.Scheme
-	} else if hr.Request.TLS == nil {
-		scheme = "http"
-	} else {
-		scheme = "https"
-	}
+// pathUri returns the path and the query of the request, Uri is the whole
+// url of a request in absolute form.
+func (hr *HttpRequest) pathUri() string {
+	return hr.Request.URL.RequestURI()
+}
 
-	if hr.Xheaders == true {
-		proto := hr.HeaderDefault("X-Forwarded-Proto", scheme)
-		proto = hr.HeaderDefault("X-Scheme", proto)
-		if proto == "http" {
-			scheme = "http"
-		}
-		if proto == "https" {
-			scheme = proto
-		}
-	}
-	return scheme
+// Scheme returns "http" or "https", the one the client used if the request
+// comes through trusted proxies, see TrustedProxies and Xheaders.
+func (hr *HttpRequest) Scheme() string {
+	return hr.forwarded().scheme
 }
 
-//contain port
+// Host returns the host the client asked for, with the port if it has
+// one, taken from the trusted proxies like Scheme.
 func (hr *HttpRequest) Host() string {
-	return hr.Request.Host
+	return hr.forwarded().host
+}
+
+// HostName returns Host without the port, an IPv6 address keeps its
+// brackets.
+func (hr *HttpRequest) HostName() string {
+	return hostName(hr.Host())
+}
+
+// Port returns the port of Host, or the default port of Scheme.
+func (hr *HttpRequest) Port() int {
+	if _, port, err := net.SplitHostPort(hr.Host()); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			return p
+		}
+	}
+	if hr.Scheme() == "https" {
+		return 443
+	}
+	return 80
 }
 
 func (hr *HttpRequest) FullUrl() string {
@@ -152,25 +184,11 @@ func (hr *HttpRequest) HeaderDefault(key, defaults string) string {
 
 }
 
+// RemoteIP returns the IP address of the client. Behind trusted proxies
+// it walks X-Forwarded-For, or the Forwarded header, from the right and
+// returns the first address which is not a trusted proxy.
 func (hr *HttpRequest) RemoteIP() string {
-	var ip string
-
-	raddr := strings.Split(hr.Request.RemoteAddr, ":")
-	if len(raddr) > 0 {
-		ip = raddr[0]
-	} else {
-		ip = "127.0.0.1"
-	}
-	if hr.Xheaders == true {
-		ips := hr.Proxy()
-		if len(ips) > 0 && ips[0] != "" {
-			ip = strings.Split(ips[0], ":")[0]
-			ip = hr.HeaderDefault("X-Real-Ip", ip)
-
-		}
-	}
-	return ip
-
+	return hr.forwarded().ip
 }
 
 func (hr *HttpRequest) Proxy() []string {
@@ -0,0 +1,72 @@
+package lemon
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acmeChallengePath is never redirected to https, certificate authorities
+// validate the domains over http on it.
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// initHttps installs the https middleware before every other one, if
+// HttpsRedirect or HstsMaxAge is set.
+func (app *Application) initHttps() {
+	if app.HttpsRedirect || app.HstsMaxAge > 0 {
+		app.middlewares = append([]Middleware{app.httpsMiddleware}, app.middlewares...)
+	}
+}
+
+// httpsMiddleware redirects the http requests to https if HttpsRedirect is
+// on, and adds the Strict-Transport-Security header to the https responses
+// if HstsMaxAge is set. The scheme of the requests forwarded by a proxy is
+// taken from the proxy headers when Xheaders is on.
+func (app *Application) httpsMiddleware(ctx *RouteContext, next func()) {
+	request := ctx.Request
+	if request.Scheme() == "https" {
+		if app.HstsMaxAge > 0 {
+			ctx.ResponseWriter.Header().Set("Strict-Transport-Security", app.hstsHeader())
+		}
+		next()
+		return
+	}
+	if !app.HttpsRedirect || strings.HasPrefix(request.Url(), acmeChallengePath) {
+		next()
+		return
+	}
+	code := http.StatusMovedPermanently
+	if method := request.Method(); method != "GET" && method != "HEAD" {
+		// keeps the method and the body
+		code = http.StatusPermanentRedirect
+	}
+	url := "https://" + app.httpsHost(request.Host()) + request.pathUri()
+	http.Redirect(ctx.ResponseWriter, request.Request, url, code)
+}
+
+// httpsHost returns host with the port of HttpsPort.
+func (app *Application) httpsHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if app.HttpsPort != 0 && app.HttpsPort != 443 {
+		host = host + ":" + strconv.Itoa(app.HttpsPort)
+	}
+	return host
+}
+
+func (app *Application) hstsHeader() string {
+	header := fmt.Sprintf("max-age=%d", app.HstsMaxAge)
+	if app.HstsIncludeSubdomains {
+		header += "; includeSubDomains"
+	}
+	if app.HstsPreload {
+		header += "; preload"
+	}
+	return header
+}
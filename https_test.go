@@ -0,0 +1,70 @@
+package lemon
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHttpsMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		method   string
+		url      string
+		headers  map[string]string
+		code     int
+		location string
+		hsts     string
+	}{
+		{"GET redirected", map[string]interface{}{"HttpsRedirect": true}, "GET", "/items?id=1", nil,
+			301, "https://example.com/items?id=1", ""},
+		{"HEAD redirected", map[string]interface{}{"HttpsRedirect": true}, "HEAD", "/items", nil,
+			301, "https://example.com/items", ""},
+		{"POST keeps its method", map[string]interface{}{"HttpsRedirect": true}, "POST", "/items", nil,
+			308, "https://example.com/items", ""},
+		{"absolute form", map[string]interface{}{"HttpsRedirect": true}, "GET", "http://example.com/items?id=1", nil,
+			301, "https://example.com/items?id=1", ""},
+		{"HttpsPort", map[string]interface{}{"HttpsRedirect": true, "HttpsPort": 8443}, "GET", "http://example.com:8080/items", nil,
+			301, "https://example.com:8443/items", ""},
+		{"HttpsPort 443", map[string]interface{}{"HttpsRedirect": true, "HttpsPort": 443}, "GET", "http://example.com:8080/items", nil,
+			301, "https://example.com/items", ""},
+		{"IPv6 host", map[string]interface{}{"HttpsRedirect": true, "HttpsPort": 8443}, "GET", "http://[2001:db8::1]:8080/items", nil,
+			301, "https://[2001:db8::1]:8443/items", ""},
+		{"ACME challenge", map[string]interface{}{"HttpsRedirect": true}, "GET", acmeChallengePath + "token", nil,
+			200, "", ""},
+		{"no redirect", map[string]interface{}{"HstsMaxAge": 3600}, "GET", "/items", nil,
+			200, "", ""},
+		{"https", map[string]interface{}{"HttpsRedirect": true}, "GET", "https://example.com/items", nil,
+			200, "", ""},
+		{"HSTS", map[string]interface{}{"HstsMaxAge": 3600}, "GET", "https://example.com/items", nil,
+			200, "", "max-age=3600"},
+		{"HSTS includeSubDomains preload", map[string]interface{}{"HstsMaxAge": 63072000, "HstsIncludeSubdomains": true, "HstsPreload": true},
+			"GET", "https://example.com/items", nil, 200, "", "max-age=63072000; includeSubDomains; preload"},
+		{"HSTS preload", map[string]interface{}{"HstsMaxAge": 3600, "HstsPreload": true}, "GET", "https://example.com/items", nil,
+			200, "", "max-age=3600; preload"},
+		{"forwarded https", map[string]interface{}{"HttpsRedirect": true, "HstsMaxAge": 3600, "Xheaders": true}, "GET", "/items",
+			map[string]string{"X-Forwarded-For": "203.0.113.9", "X-Forwarded-Proto": "https"}, 200, "", "max-age=3600"},
+		{"forwarded https not trusted", map[string]interface{}{"HttpsRedirect": true, "HstsMaxAge": 3600}, "GET", "/items",
+			map[string]string{"X-Forwarded-For": "203.0.113.9", "X-Forwarded-Proto": "https"}, 301, "https://example.com/items", ""},
+	}
+	for _, test := range tests {
+		settings := map[string]interface{}{"CookieSecret": "secret"}
+		for key, value := range test.settings {
+			settings[key] = value
+		}
+		app := NewApplication()
+		app.Init([]UrlSpec{AddRouter("/.*", &postHandler{}, nil, "")}, settings)
+		r := httptest.NewRequest(test.method, test.url, nil)
+		for key, value := range test.headers {
+			r.Header.Set(key, value)
+		}
+		rw := httptest.NewRecorder()
+		app.ServeHTTP(rw, r)
+		if rw.Code != test.code || rw.Header().Get("Location") != test.location {
+			t.Errorf("%s: %d %q, want %d %q", test.name, rw.Code, rw.Header().Get("Location"), test.code, test.location)
+		}
+		if hsts := rw.Header().Get("Strict-Transport-Security"); hsts != test.hsts {
+			t.Errorf("%s: Strict-Transport-Security %q, want %q", test.name, hsts, test.hsts)
+		}
+	}
+}
@@ -1,25 +1,41 @@
 package lemon
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
-	"net/http/fcgi"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type Lemon struct {
-	Server  *http.Server
-	app     *Application
-	address string
-	port    int
-	network string //used in the mode of fastcgi, value is ''(standard I/O), 'tcp', 'unix'
+	Server        *http.Server
+	app           *Application
+	address       string
+	port          int
+	listenConfigs []listenConfig // listeners added by Listen, ListenTLS, ListenUnix and ListenSystemd
+	shutdownHooks []func()
+	shutdownOnce  sync.Once
+	shutdownErr   error
+	listeners     []net.Listener          // listeners served, handed down by Restart
+	inherited     []net.Listener          // listeners handed down by the parent process, not served yet
+	listenerNames map[net.Listener]string // names given by systemd to the listeners
+	systemd       []net.Listener          // sockets passed by systemd, not served yet
+	readyPipe     *os.File                // tells the parent process this one is serving
+	handover      int32                   // set once Restart closes the listeners
+	handedOver    chan struct{}           // closed when the accepted connections may be shut down
+	fcgiServer    *fcgiServer             // serves the FastCGI connections of FCGILoop
+	certificates  *certificateStore       // certificates of the https listeners
 }
 
 func NewLemon() *Lemon {
-	return &Lemon{Server: &http.Server{}}
+	return &Lemon{Server: &http.Server{}, handedOver: make(chan struct{})}
 }
 
 func (lem *Lemon) Instance(urlSpecs []UrlSpec, settings map[string]interface{}) *Lemon {
@@ -38,75 +54,317 @@ func (lem *Lemon) Instance(urlSpecs []UrlSpec, settings map[string]interface{})
 	return lem
 }
 
+// Application returns the Application created by Instance, e.g. to add
+// route groups.
+func (lem *Lemon) Application() *Application {
+	return lem.app
+}
+
+// Listen serves on address and port, https if CertFile is set and no
+// listener is added by ListenTLS, http otherwise. It may be called several
+// times, Loop serves all the listeners added.
 func (lem *Lemon) Listen(address string, port int) {
 
 	lem.port = port
 	lem.address = address
+	lem.listenConfigs = append(lem.listenConfigs, listenConfig{
+		network: "tcp",
+		address: fmt.Sprintf("%s:%d", address, port),
+	})
 
 }
 
-func (lem *Lemon) FCGILoop(network string) {
+// FCGILoop serves FastCGI until the server is shut down, like Loop. With
+// network "" it serves on the socket the web server passed as standard
+// input, otherwise on the listeners added by Listen, ListenUnix or
+// ListenSystemd, "unix" after Listen takes its address as the socket path.
+func (lem *Lemon) FCGILoop(network string) error {
+	var listeners []*lemonListener
 	if network == "" {
-		err := fcgi.Serve(nil, lem.Server.Handler) // standard I/O
-		if err == nil {
-			fmt.Println("Use FCGI via standard I/O")
-		} else {
-			fmt.Println("Cannot use FCGI via standard I/O", err)
+		l, err := net.FileListener(os.Stdin)
+		if err != nil {
+			return errors.New(fmt.Sprintf("cannot use FCGI via standard I/O, the standard input is not a socket: %v", err))
+		}
+		lem.listeners = append(lem.listeners, l)
+		listeners = []*lemonListener{{Listener: l}}
+	} else {
+		if network == "unix" && len(lem.listenConfigs) == 1 && lem.listenConfigs[0].network == "tcp" {
+			// the address given to Listen is the socket path
+			lem.listenConfigs = nil
+			lem.ListenUnix(lem.address, 0, "")
+		}
+		var err error
+		if listeners, err = lem.openListeners(""); err != nil {
+			return err
 		}
-	} else if network == "tcp" {
-		lem.address = fmt.Sprintf("%s:%d", lem.address, lem.port)
 	}
-	l, err := net.Listen(lem.network, lem.address)
-	if err != nil {
-		fmt.Println("Listen: ", err)
+	for _, l := range listeners {
+		lemonLag.Info(fmt.Sprintf("fastcgi server Running on %s", l.Addr()))
+	}
+	lem.fcgiServer = newFcgiServer(lem.Server.Handler)
+	lem.fcgiServer.maxBodyBytes = int64(lem.app.FCGIMaxBodyBytes)
+	return lem.serve(listeners, func(l *lemonListener) error {
+		return lem.fcgiServer.Serve(l.Listener)
+	})
+}
+
+// Loop serves every listener added until the server is shut down by
+// Shutdown, SIGINT or SIGTERM, all of them share the Application. The
+// listeners added by ListenTLS serve https, the other ones serve https if
+// CertFile and KeyFile are set and there is no ListenTLS, http otherwise.
+// Without listener it serves on the address of Server. It returns nil
+// after a graceful shutdown and the error of the listeners otherwise. With
+// Processes set it starts the worker processes and supervises them, see
+// runWorkers.
+func (lem *Lemon) Loop() error {
+	if lem.prefork() {
+		return lem.runWorkers()
 	}
-	err = fcgi.Serve(l, lem.Server.Handler)
+	defaultTls := !lem.hasTLSListener() && lem.app.hasCertificates()
+	defaultAddress := ":http"
+	if defaultTls {
+		defaultAddress = ":https"
+	}
+	listeners, err := lem.openListeners(defaultAddress)
 	if err != nil {
-		fmt.Println("Listen Error: ", err)
+		return err
 	}
-
+	for _, l := range listeners {
+		l.tls = l.tls || defaultTls
+	}
+	return lem.serveListeners(listeners)
 }
 
-func (lem *Lemon) Loop() {
-	lem.Server.Addr = fmt.Sprintf("%s:%d", lem.address, lem.port)
+// ListenHttpTLs serves https on every listener added, like Loop.
+func (lem *Lemon) ListenHttpTLs() error {
+	if lem.prefork() {
+		return lem.runWorkers()
+	}
+	listeners, err := lem.openListeners(":https")
+	if err != nil {
+		return err
+	}
+	for _, l := range listeners {
+		l.tls = true
+	}
+	return lem.serveListeners(listeners)
+}
 
-	if len(lem.app.CertFile) != 0 || len(lem.app.KeyFile) != 0 {
-		_, HasCertFile := os.Stat(lem.app.CertFile)
-		if HasCertFile != nil {
-			errorString := fmt.Sprintf("certfile %s does not exist", lem.app.CertFile)
-			errors.New(errorString)
-			return
+// ListenHttp serves http on every listener added, like Loop.
+func (lem *Lemon) ListenHttp() error {
+	if lem.prefork() {
+		return lem.runWorkers()
+	}
+	listeners, err := lem.openListeners(":http")
+	if err != nil {
+		return err
+	}
+	for _, l := range listeners {
+		l.tls = false
+	}
+	return lem.serveListeners(listeners)
+}
 
+// serveListeners loads the certificates if a listener serves https, and
+// serves the listeners, reading the PROXY protocol header of the
+// connections if ProxyProtocol is set.
+func (lem *Lemon) serveListeners(listeners []*lemonListener) error {
+	for _, l := range listeners {
+		if len(lem.app.proxyNetworks) != 0 {
+			l.Listener = newProxyListener(l.Listener, lem.app.proxyNetworks)
 		}
-		_, HasKeyFile := os.Stat(lem.app.KeyFile)
-		if HasKeyFile != nil {
-			errorString := fmt.Sprintf("keyfile %s does not exist", lem.app.KeyFile)
-			errors.New(errorString)
-			return
+		if !l.tls {
+			lemonLag.Info(fmt.Sprintf("http server Running on %s", l.Addr()))
+			continue
 		}
-		lem.ListenHttpTLs()
-	} else {
-		lem.ListenHttp()
+		if lem.certificates == nil {
+			if err := lem.loadCertificates(); err != nil {
+				for _, l := range listeners {
+					l.Close()
+				}
+				return err
+			}
+		}
+		if tcpAddr, ok := l.Addr().(*net.TCPAddr); ok && lem.app.HttpsPort == 0 {
+			lem.app.HttpsPort = tcpAddr.Port
+		}
+		lemonLag.Info(fmt.Sprintf("https server Running on %s", l.Addr()))
 	}
-
+	if lem.certificates != nil && lem.app.TLSReloadInterval > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go lem.certificates.watch(time.Duration(lem.app.TLSReloadInterval)*time.Second, stop)
+	}
+	return lem.serve(listeners, func(l *lemonListener) error {
+		if l.tls {
+			// the certificates come from Server.TLSConfig.GetCertificate
+			return lem.Server.ServeTLS(l.Listener, "", "")
+		}
+		return lem.Server.Serve(l.Listener)
+	})
 }
 
-func (lem *Lemon) ListenHttpTLs() {
-	time.Sleep(20 * time.Microsecond)
-	fmt.Println("https server Running on ", lem.address)
-	err := lem.Server.ListenAndServeTLS(lem.app.CertFile, lem.app.KeyFile)
+// loadCertificates loads the certificates and sets the TLS configuration
+// of Server.
+func (lem *Lemon) loadCertificates() error {
+	if !lem.app.hasCertificates() {
+		return errors.New("CertFile and KeyFile or Certificates must be set to serve https")
+	}
+	store := newCertificateStore(lem.app)
+	if err := store.load(); err != nil {
+		return err
+	}
+	config, err := tlsConfig(lem.app, lem.Server.TLSConfig, store)
 	if err != nil {
-		fmt.Println("ListenAndServeTLS: ", err)
-		time.Sleep(100 * time.Microsecond)
+		return err
 	}
+	lem.Server.TLSConfig = config
+	lem.certificates = store
+	lemonLag.Info(fmt.Sprintf("certificates of %s", strings.Join(store.names(), ", ")))
+	return nil
 }
 
-func (lem *Lemon) ListenHttp() {
-	time.Sleep(20 * time.Microsecond)
-	fmt.Println("http server Running on ", lem.Server.Addr)
-	err := lem.Server.ListenAndServe()
-	if err != nil {
-		fmt.Println("ListenAndServe: ", err)
-		time.Sleep(100 * time.Microsecond)
+// ReloadCertificates loads the certificates again from their files, the
+// new TLS connections use them and the established ones are left alone. It
+// is called on SIGHUP.
+func (lem *Lemon) ReloadCertificates() {
+	if lem.certificates != nil {
+		lem.certificates.reload()
+	}
+}
+
+// serve runs serveListener on every listener and shuts the server down on
+// SIGINT or SIGTERM, or after a Restart on SIGUSR2 if GracefulRestart is
+// on or on a new build of Autoreload, and reloads the certificates on
+// SIGHUP. A second signal is not caught, so it kills a shutdown that hangs.
+// If a listener fails the others are closed.
+func (lem *Lemon) serve(listeners []*lemonListener, serveListener func(*lemonListener) error) error {
+	signals := make(chan os.Signal, 1)
+	notified := []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	if lem.app.GracefulRestart && restartSignal != nil && workerID() < 0 {
+		// a worker is restarted by the master
+		notified = append(notified, restartSignal)
+	}
+	if lem.certificates != nil || workerID() >= 0 {
+		// the master passes SIGHUP on to the workers
+		notified = append(notified, syscall.SIGHUP)
 	}
+	signal.Notify(signals, notified...)
+	stopped := make(chan struct{})
+	rebuilt := make(chan string)
+	if lem.app.Autoreload && workerID() < 0 {
+		watching := make(chan struct{})
+		go func() {
+			lem.autoreload(rebuilt, stopped)
+			close(watching)
+		}()
+		defer func() { <-watching }()
+	}
+	defer close(stopped)
+	go func() {
+		for {
+			select {
+			case executable := <-rebuilt:
+				if !lem.restartBuild(executable) {
+					continue
+				}
+				signal.Stop(signals)
+				lem.Shutdown()
+				return
+			case sig := <-signals:
+				if sig == syscall.SIGHUP {
+					lemonLag.Info(fmt.Sprintf("Received %v, reloading the certificates", sig))
+					lem.ReloadCertificates()
+					continue
+				}
+				if sig == restartSignal {
+					lemonLag.Info(fmt.Sprintf("Received %v, restarting", sig))
+					if err := lem.Restart(); err != nil {
+						lemonLag.Error(fmt.Sprintf("Restart: %v", err))
+						continue
+					}
+				} else {
+					lemonLag.Info(fmt.Sprintf("Received %v, shutting down", sig))
+				}
+				signal.Stop(signals)
+				lem.Shutdown()
+				return
+			case <-stopped:
+				signal.Stop(signals)
+				return
+			}
+		}
+	}()
+
+	lem.ready()
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *lemonListener) {
+			errs <- serveListener(l)
+		}(l)
+	}
+	err := <-errs
+	if lem.handingOver() {
+		// the listeners were closed by Restart
+		<-lem.handedOver
+		return lem.Shutdown()
+	}
+	if err == http.ErrServerClosed {
+		// wait until the requests are drained and the hooks have run
+		return lem.Shutdown()
+	}
+	lem.close()
+	return err
+}
+
+// OnShutdown registers hooks called by Shutdown once the in-flight requests
+// are finished, in the order they were registered.
+func (lem *Lemon) OnShutdown(hooks ...func()) {
+	lem.shutdownHooks = append(lem.shutdownHooks, hooks...)
+}
+
+// Shutdown stops accepting connections, waits for the in-flight requests
+// at most ShutdownTimeOut, closes the connections left and runs the
+// OnShutdown hooks. It only shuts down once, later calls wait for the first
+// one and return its result.
+func (lem *Lemon) Shutdown() error {
+	lem.shutdownOnce.Do(func() {
+		ctx := context.Background()
+		if lem.app != nil && lem.app.ShutdownTimeOut > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, lem.app.ShutdownTimeOut)
+			defer cancel()
+		}
+		err := lem.Server.Shutdown(ctx)
+		if err == nil && lem.fcgiServer != nil {
+			err = lem.fcgiServer.Shutdown(ctx)
+		}
+		if err != nil {
+			lemonLag.Warning(fmt.Sprintf("Shutdown: %v, closing the connections left", err))
+			lem.close()
+			lem.shutdownErr = err
+		}
+		for _, hook := range lem.shutdownHooks {
+			lem.runShutdownHook(hook)
+		}
+	})
+	return lem.shutdownErr
+}
+
+// close closes the listeners and the connections at once.
+func (lem *Lemon) close() {
+	lem.Server.Close()
+	if lem.fcgiServer != nil {
+		lem.fcgiServer.Close()
+	}
+}
+
+// runShutdownHook runs hook, a panic is logged so the next hooks still run.
+func (lem *Lemon) runShutdownHook(hook func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			lemonLag.Error(fmt.Sprintf("Error in shutdown hook:%v", err))
+		}
+	}()
+	hook()
 }
@@ -0,0 +1,139 @@
+package lemon
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowHandler answers once the "release" channel of its kwargs is closed,
+// it tells it started on "started".
+type slowHandler struct {
+	RequestHandler
+	started chan<- struct{}
+	release <-chan struct{}
+}
+
+func (h *slowHandler) Initialize(params Dictionary) {
+	h.started = params["started"].(chan struct{})
+	h.release = params["release"].(chan struct{})
+}
+
+func (h *slowHandler) Get(args ...string) {
+	h.started <- struct{}{}
+	<-h.release
+	h.Write([]byte("done"))
+}
+
+// startSlowServer serves slowHandler on a loopback port with the
+// ShutdownTimeOut timeout, it returns the url served and the result of
+// serve.
+func startSlowServer(t *testing.T, timeout time.Duration, started, release chan struct{}) (*Lemon, string, <-chan error) {
+	lem := NewLemon().Instance([]UrlSpec{
+		AddRouter("/slow", &slowHandler{}, Dictionary{"started": started, "release": release}, ""),
+	}, map[string]interface{}{"CookieSecret": "secret"})
+	// the setting is in seconds
+	lem.Application().ShutdownTimeOut = timeout
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- lem.serveListeners([]*lemonListener{{Listener: l}})
+	}()
+	return lem, "http://" + l.Addr().String() + "/slow", served
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	lem, url, served := startSlowServer(t, 5*time.Second, started, release)
+	var hooks int32
+	lem.OnShutdown(func() { atomic.AddInt32(&hooks, 1) })
+
+	type result struct {
+		body string
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		response, err := http.Get(url)
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		responses <- result{string(body), err}
+	}()
+	<-started
+	shutdown := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { shutdown <- lem.Shutdown() }()
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a request in flight", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if atomic.LoadInt32(&hooks) != 0 {
+		t.Error("hook run before the request finished")
+	}
+	close(release)
+	if r := <-responses; r.err != nil || r.body != "done" {
+		t.Errorf("in-flight request: %q %v", r.body, r.err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-shutdown; err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+	if err := lem.Shutdown(); err != nil {
+		t.Errorf("Shutdown again: %v", err)
+	}
+	if n := atomic.LoadInt32(&hooks); n != 1 {
+		t.Errorf("hook run %d times", n)
+	}
+}
+
+func TestShutdownTimeOut(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	lem, url, served := startSlowServer(t, 200*time.Millisecond, started, release)
+	var order []string
+	lem.OnShutdown(func() { panic("first hook") }, func() { order = append(order, "second") })
+	lem.OnShutdown(func() { order = append(order, "third") })
+
+	requested := make(chan error, 1)
+	go func() {
+		response, err := http.Get(url)
+		if err == nil {
+			_, err = io.ReadAll(response.Body)
+			response.Body.Close()
+		}
+		requested <- err
+	}()
+	<-started
+	begin := time.Now()
+	if err := lem.Shutdown(); err == nil {
+		t.Error("Shutdown returned nil with a request left")
+	}
+	if elapsed := time.Since(begin); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Shutdown took %v with ShutdownTimeOut 200ms", elapsed)
+	}
+	if err := <-requested; err == nil {
+		t.Error("the request left got a response")
+	}
+	if err := <-served; err == nil {
+		t.Error("serve returned nil after the timeout")
+	}
+	if len(order) != 2 || order[0] != "second" || order[1] != "third" {
+		t.Errorf("hooks after a panicking one: %v", order)
+	}
+}
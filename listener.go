@@ -0,0 +1,317 @@
+package lemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// The listeners a Lemon serves on are added by Listen, ListenTLS,
+// ListenUnix and ListenSystemd, and served together by Loop, ListenHttp,
+// ListenHttpTLs or FCGILoop.
+const (
+	listenSystemdFdsStart = 3 // SD_LISTEN_FDS_START
+	envListenPid          = "LISTEN_PID"
+	envListenFds          = "LISTEN_FDS"
+	envListenFdNames      = "LISTEN_FDNAMES"
+)
+
+// listenConfig is a listener added to a Lemon.
+type listenConfig struct {
+	network string // "tcp", "unix" or "systemd"
+	address string
+	mode    os.FileMode
+	owner   string
+	tls     bool     // added by ListenTLS
+	names   []string // sockets selected by ListenSystemd
+}
+
+// lemonListener is an opened listener.
+type lemonListener struct {
+	net.Listener
+	tls bool // must serve https whatever CertFile
+}
+
+// ListenTLS serves https on address and port, with the certificate of
+// CertFile and KeyFile. Once a listener is added by ListenTLS the other
+// ones serve plain http.
+func (lem *Lemon) ListenTLS(address string, port int) {
+	lem.listenConfigs = append(lem.listenConfigs, listenConfig{
+		network: "tcp",
+		address: fmt.Sprintf("%s:%d", address, port),
+		tls:     true,
+	})
+}
+
+// ListenUnix serves on the unix domain socket path, the socket file gets
+// mode and owner ("user", "user:group" or ":group", names or ids) if they
+// are not empty. A socket file left by a process which exited is removed.
+func (lem *Lemon) ListenUnix(path string, mode os.FileMode, owner string) {
+	lem.listenConfigs = append(lem.listenConfigs, listenConfig{network: "unix", address: path, mode: mode, owner: owner})
+}
+
+// ListenSystemd serves on the sockets passed by systemd socket activation,
+// see sd_listen_fds(3). The sockets named "https" by FileDescriptorName
+// serve https.
+//
+// With names only the sockets of these FileDescriptorName are served,
+// without it the ones not selected by name in another ListenSystemd.
+func (lem *Lemon) ListenSystemd(names ...string) {
+	lem.listenConfigs = append(lem.listenConfigs, listenConfig{network: "systemd", names: names})
+}
+
+// hasTLSListener reports whether a listener was added by ListenTLS.
+func (lem *Lemon) hasTLSListener() bool {
+	for _, config := range lem.listenConfigs {
+		if config.tls {
+			return true
+		}
+	}
+	return false
+}
+
+// openListeners opens the listeners added, or a tcp listener on the
+// address of Server, defaultAddress if it is not set.
+func (lem *Lemon) openListeners(defaultAddress string) ([]*lemonListener, error) {
+	configs := lem.listenConfigs
+	if len(configs) == 0 {
+		address := lem.Server.Addr
+		if len(address) == 0 {
+			address = defaultAddress
+		}
+		configs = []listenConfig{{network: "tcp", address: address}}
+	}
+	listeners := []*lemonListener{}
+	for _, config := range configs {
+		var opened []*lemonListener
+		var err error
+		switch config.network {
+		case "unix":
+			var l net.Listener
+			if l, err = lem.listenUnix(config.address, config.mode, config.owner); err == nil {
+				opened = []*lemonListener{{Listener: l}}
+			}
+		case "systemd":
+			opened, err = lem.listenSystemd(config.names)
+		default:
+			var l net.Listener
+			if l, err = lem.listenTcp(config.address); err == nil {
+				opened = []*lemonListener{{Listener: l, tls: config.tls}}
+			}
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, opened...)
+	}
+	return listeners, nil
+}
+
+func (lem *Lemon) listenTcp(address string) (net.Listener, error) {
+	l, err := lem.inheritedListener("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		config := net.ListenConfig{}
+		if workerID() >= 0 {
+			// every worker binds the address
+			config.Control = reusePort
+		}
+		if l, err = config.Listen(context.Background(), "tcp", address); err != nil {
+			return nil, err
+		}
+	}
+	lem.listeners = append(lem.listeners, l)
+	return l, nil
+}
+
+func (lem *Lemon) listenUnix(path string, mode os.FileMode, owner string) (net.Listener, error) {
+	l, err := lem.inheritedListener("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		if unixListener, ok := l.(*net.UnixListener); ok {
+			// removed on shutdown like the sockets created here, unless
+			// the master of the workers owns it
+			unixListener.SetUnlinkOnClose(workerID() < 0)
+		}
+		lem.listeners = append(lem.listeners, l)
+		return l, nil
+	}
+	abstract := strings.HasPrefix(path, "@")
+	if !abstract {
+		removeStaleSocket(path)
+	}
+	l, err = net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if !abstract {
+		if err = setSocketOwner(path, mode, owner); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	lem.listeners = append(lem.listeners, l)
+	return l, nil
+}
+
+// removeStaleSocket removes the socket file path if nobody listens on it.
+func removeStaleSocket(path string) {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+func setSocketOwner(path string, mode os.FileMode, owner string) error {
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if len(owner) == 0 {
+		return nil
+	}
+	uid, gid := -1, -1
+	userName, groupName := owner, ""
+	if i := strings.Index(owner, ":"); i >= 0 {
+		userName, groupName = owner[:i], owner[i+1:]
+	}
+	if len(userName) != 0 {
+		id, err := strconv.Atoi(userName)
+		if err != nil {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return err
+			}
+			id, _ = strconv.Atoi(u.Uid)
+		}
+		uid = id
+	}
+	if len(groupName) != 0 {
+		id, err := strconv.Atoi(groupName)
+		if err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return err
+			}
+			id, _ = strconv.Atoi(g.Gid)
+		}
+		gid = id
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// listenSystemd returns the sockets passed by systemd, or the ones handed
+// down by Restart in a process started from a socket activated one, named
+// one of names, or not selected by another ListenSystemd if names is
+// empty.
+func (lem *Lemon) listenSystemd(names []string) ([]*lemonListener, error) {
+	if lem.systemd == nil {
+		if err := lem.inheritListeners(); err != nil {
+			return nil, err
+		}
+		lem.systemd = lem.inherited
+		lem.inherited = nil
+		if len(lem.systemd) == 0 {
+			var err error
+			if lem.systemd, err = lem.systemdListeners(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	selected := []string{}
+	for _, config := range lem.listenConfigs {
+		selected = append(selected, config.names...)
+	}
+	opened := []*lemonListener{}
+	rest := []net.Listener{}
+	for _, l := range lem.systemd {
+		name := lem.listenerNames[l]
+		if len(names) != 0 && !containsString(names, name) || len(names) == 0 && containsString(selected, name) {
+			rest = append(rest, l)
+			continue
+		}
+		lem.listeners = append(lem.listeners, l)
+		opened = append(opened, &lemonListener{Listener: l, tls: name == "https"})
+	}
+	lem.systemd = rest
+	if len(opened) == 0 && len(names) != 0 {
+		return nil, errors.New(fmt.Sprintf("no socket named %s passed by systemd", strings.Join(names, " or ")))
+	}
+	if len(opened) == 0 {
+		return nil, errors.New(fmt.Sprintf("no socket passed by systemd but the ones named %s", strings.Join(selected, " or ")))
+	}
+	return opened, nil
+}
+
+// containsString reports whether s is one of values.
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+// systemdListeners reads the sockets passed in LISTEN_FDS and their names,
+// the variables are unset so the processes started later don't take them.
+func (lem *Lemon) systemdListeners() ([]net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv(envListenPid))
+	count, _ := strconv.Atoi(os.Getenv(envListenFds))
+	names := strings.Split(os.Getenv(envListenFdNames), ":")
+	os.Unsetenv(envListenPid)
+	os.Unsetenv(envListenFds)
+	os.Unsetenv(envListenFdNames)
+	if pid != os.Getpid() || count <= 0 {
+		return nil, errors.New("no socket passed by systemd, is the service socket activated?")
+	}
+	listeners := []net.Listener{}
+	for i := 0; i < count; i++ {
+		fd := listenSystemdFdsStart + i
+		file := os.NewFile(uintptr(fd), "systemd")
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, errors.New(fmt.Sprintf("systemd socket %d: %v", fd, err))
+		}
+		if i < len(names) {
+			lem.setListenerName(l, names[i])
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// setListenerName records the name systemd gave to l, it is handed down
+// by Restart with the socket.
+func (lem *Lemon) setListenerName(l net.Listener, name string) {
+	if len(name) == 0 {
+		return
+	}
+	if lem.listenerNames == nil {
+		lem.listenerNames = map[net.Listener]string{}
+	}
+	lem.listenerNames[l] = name
+}
@@ -0,0 +1,63 @@
+package lemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+// TestListenSystemdNames runs itself in a process which gets two sockets
+// named "web" and "admin" like systemd passes them.
+func TestListenSystemdNames(t *testing.T) {
+	if os.Getenv("LEMON_TEST_SYSTEMD") == "1" {
+		os.Setenv(envListenPid, fmt.Sprint(os.Getpid()))
+		lem := NewLemon()
+		lem.ListenSystemd()
+		lem.ListenSystemd("admin")
+		listeners, err := lem.openListeners("")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for _, l := range listeners {
+			fmt.Println(l.Addr(), lem.listenerNames[l.Listener])
+		}
+		if _, err := lem.listenSystemd([]string{"other"}); err == nil {
+			fmt.Println("a socket named other was served")
+		}
+		os.Exit(0)
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("no socket activation on windows")
+	}
+	var files []*os.File
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		file, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		files = append(files, file)
+		addrs = append(addrs, l.Addr().String())
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestListenSystemdNames$")
+	cmd.Env = append(os.Environ(), "LEMON_TEST_SYSTEMD=1", envListenFds+"=2", envListenFdNames+"=web:admin")
+	cmd.ExtraFiles = files
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	want := fmt.Sprintf("%s web\n%s admin\n", addrs[0], addrs[1])
+	if string(output) != want {
+		t.Errorf("served %q, want %q", output, want)
+	}
+}
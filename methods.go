@@ -0,0 +1,146 @@
+package lemon
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sync"
+)
+
+// handlerMethods maps the HTTP methods to the HandlerInterface methods
+// serving them.
+var handlerMethods = []struct {
+	method string
+	name   string
+}{
+	{"GET", "Get"},
+	{"HEAD", "Head"},
+	{"POST", "Post"},
+	{"DELETE", "Delete"},
+	{"PATCH", "Patch"},
+	{"PUT", "Put"},
+	{"OPTIONS", "Options"},
+}
+
+var requestHandlerType = reflect.TypeOf(RequestHandler{})
+
+// allowedMethodsCache caches the allowed methods of each handler type.
+var allowedMethodsCache sync.Map
+
+// allowedMethods returns the HTTP methods a handler struct type answers:
+// the ones whose method it overrides, HEAD when it overrides Get, and
+// OPTIONS which is always answered.
+func allowedMethods(handlerType reflect.Type) []string {
+	if methods, ok := allowedMethodsCache.Load(handlerType); ok {
+		return methods.([]string)
+	}
+	hasGet := implementsMethod(handlerType, "Get")
+	methods := []string{}
+	for _, hm := range handlerMethods {
+		if implementsMethod(handlerType, hm.name) ||
+			(hm.method == "HEAD" && hasGet) || hm.method == "OPTIONS" {
+			methods = append(methods, hm.method)
+		}
+	}
+	allowedMethodsCache.Store(handlerType, methods)
+	return methods
+}
+
+// implementsMethod reports whether the method name of handlerType is not
+// the default one promoted from RequestHandler.
+func implementsMethod(handlerType reflect.Type, name string) bool {
+	owner := methodOwner(handlerType, name)
+	return owner != nil && owner != requestHandlerType
+}
+
+// overriddenMethodsCache caches overridesMethod by handler type and method
+// name.
+var overriddenMethodsCache sync.Map
+
+// overridesMethod is implementsMethod cached, for the methods looked up on
+// every request.
+func overridesMethod(handlerType reflect.Type, name string) bool {
+	key := [2]interface{}{handlerType, name}
+	if overrides, ok := overriddenMethodsCache.Load(key); ok {
+		return overrides.(bool)
+	}
+	overrides := implementsMethod(handlerType, name)
+	overriddenMethodsCache.Store(key, overrides)
+	return overrides
+}
+
+// promotedHandler only has the methods promoted from RequestHandler.
+type promotedHandler struct {
+	RequestHandler
+}
+
+// promotedSources caches the source position of each method promoted
+// from RequestHandler.
+var promotedSources sync.Map
+
+// methodSource returns the source position of the code of method.
+func methodSource(method reflect.Method) string {
+	pc := method.Func.Pointer()
+	file, line := runtime.FuncForPC(pc).FileLine(pc)
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+// isPromoted reports whether method of a handler type is promoted from an
+// embedded field rather than declared by the type: its code comes from the
+// same source as the method promoted from RequestHandler to
+// promotedHandler, wherever the toolchain puts the code of promoted
+// methods.
+func isPromoted(method reflect.Method) bool {
+	source, ok := promotedSources.Load(method.Name)
+	if !ok {
+		promoted, ok := reflect.TypeOf(&promotedHandler{}).MethodByName(method.Name)
+		if !ok {
+			return false
+		}
+		source, _ = promotedSources.LoadOrStore(method.Name, methodSource(promoted))
+	}
+	return methodSource(method) == source.(string)
+}
+
+// methodOwner returns the struct type declaring the method name promoted
+// to structType, following the embedded fields.
+func methodOwner(structType reflect.Type, name string) reflect.Type {
+	if structType == requestHandlerType {
+		return structType
+	}
+	for _, t := range []reflect.Type{reflect.PtrTo(structType), structType} {
+		if method, ok := t.MethodByName(name); ok && !isPromoted(method) {
+			return structType
+		}
+	}
+	if structType.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if !field.Anonymous {
+			continue
+		}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() != reflect.Struct {
+			continue
+		}
+		if _, ok := reflect.PtrTo(fieldType).MethodByName(name); ok {
+			return methodOwner(fieldType, name)
+		}
+	}
+	return nil
+}
+
+// headResponseWriter drops the body written by Get when serving HEAD.
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (hw headResponseWriter) Write(content []byte) (int, error) {
+	return len(content), nil
+}
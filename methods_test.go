@@ -0,0 +1,78 @@
+package lemon
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type getOnlyHandler struct {
+	RequestHandler
+}
+
+func (h *getOnlyHandler) Get(args ...string) {
+	h.Write([]byte("get"))
+}
+
+// postHandler inherits Get from getOnlyHandler.
+type postHandler struct {
+	getOnlyHandler
+}
+
+func (h *postHandler) Post(args ...string) {
+	h.Write([]byte("post"))
+}
+
+type valueHandler struct {
+	*RequestHandler
+}
+
+func (h valueHandler) Put(args ...string) {}
+
+func TestAllowedMethods(t *testing.T) {
+	tests := []struct {
+		handler interface{}
+		want    []string
+	}{
+		{RequestHandler{}, []string{"OPTIONS"}},
+		{getOnlyHandler{}, []string{"GET", "HEAD", "OPTIONS"}},
+		{postHandler{}, []string{"GET", "HEAD", "POST", "OPTIONS"}},
+		{valueHandler{}, []string{"PUT", "OPTIONS"}},
+	}
+	for _, test := range tests {
+		handlerType := reflect.TypeOf(test.handler)
+		if methods := allowedMethods(handlerType); !reflect.DeepEqual(methods, test.want) {
+			t.Errorf("allowedMethods(%v) = %v, want %v", handlerType, methods, test.want)
+		}
+	}
+}
+
+func TestGetOnlyHandler(t *testing.T) {
+	app := NewApplication()
+	app.Init([]UrlSpec{AddRouter("/", &getOnlyHandler{}, nil, "")},
+		map[string]interface{}{"CookieSecret": "secret"})
+	tests := []struct {
+		method string
+		status int
+		body   string
+	}{
+		{"GET", 200, "get"},
+		{"HEAD", 200, ""},
+		{"OPTIONS", 204, ""},
+		{"POST", 405, ""},
+		{"DELETE", 405, ""},
+	}
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		app.ServeHTTP(rw, httptest.NewRequest(test.method, "/", nil))
+		if rw.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.method, rw.Code, test.status)
+		}
+		if test.status == 200 && rw.Body.String() != test.body {
+			t.Errorf("%s: body %q, want %q", test.method, rw.Body.String(), test.body)
+		}
+		if test.status != 200 && rw.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+			t.Errorf("%s: Allow %q", test.method, rw.Header().Get("Allow"))
+		}
+	}
+}
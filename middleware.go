@@ -0,0 +1,35 @@
+package lemon
+
+import (
+	"net/http"
+)
+
+// RouteContext is what a Middleware knows about the request being served
+// and the route it was dispatched to.
+type RouteContext struct {
+	Application    *Application
+	Request        *HttpRequest
+	ResponseWriter http.ResponseWriter
+	Spec           *UrlSpec   // the matched route, nil if none matched or before routing
+	Name           string     // name of the matched route, may be empty
+	Kwargs         Dictionary // passed to the handler's Initialize, a copy of the route's for each request
+	Args           []string   // passed to the handler's Get/Post/...
+}
+
+// Middleware runs around the handler of a route. It calls next to go on
+// with the request, or writes a response through ctx.ResponseWriter and
+// returns without calling next to stop it. Code after next runs once the
+// handler has finished.
+type Middleware func(ctx *RouteContext, next func())
+
+// runMiddlewares calls the middlewares in order, the last one wrapping
+// final.
+func runMiddlewares(middlewares []Middleware, ctx *RouteContext, final func()) {
+	if len(middlewares) == 0 {
+		final()
+		return
+	}
+	middlewares[0](ctx, func() {
+		runMiddlewares(middlewares[1:], ctx, final)
+	})
+}
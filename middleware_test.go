@@ -0,0 +1,95 @@
+package lemon
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type hostHandler struct {
+	RequestHandler
+}
+
+func (h *hostHandler) Get(args ...string) {
+	h.Write([]byte(h.Request.HostName() + " " + h.ReverseUrl("page")))
+}
+
+func TestUseBeforeRouting(t *testing.T) {
+	app := NewApplication()
+	app.Init(nil, map[string]interface{}{"CookieSecret": "secret"})
+	app.AddHandlers("api.example.com", []UrlSpec{AddRouter("/page", &hostHandler{}, nil, "page")})
+	var order []string
+	app.UseBeforeRouting(func(ctx *RouteContext, next func()) {
+		order = append(order, "before")
+		if ctx.Spec != nil {
+			t.Errorf("route resolved before routing: %v", ctx.Spec)
+		}
+		request := ctx.Request.Request
+		if strings.HasPrefix(request.URL.Path, "/api/") {
+			request.URL.Path = strings.TrimPrefix(request.URL.Path, "/api")
+			request.Host = "api.example.com"
+		}
+		next()
+	})
+	app.Use(func(ctx *RouteContext, next func()) {
+		order = append(order, "use "+ctx.Name)
+		next()
+	})
+	rw := httptest.NewRecorder()
+	app.ServeHTTP(rw, httptest.NewRequest("GET", "http://www.example.com/api/page", nil))
+	if rw.Code != 200 || rw.Body.String() != "api.example.com /page" {
+		t.Errorf("rewritten request: %d %q", rw.Code, rw.Body.String())
+	}
+	if strings.Join(order, ",") != "before,use page" {
+		t.Errorf("middleware order %v", order)
+	}
+}
+
+type kwargHandler struct {
+	RequestHandler
+	user string
+}
+
+func (h *kwargHandler) Initialize(params Dictionary) {
+	h.user, _ = params["user"].(string)
+	params["user"] = "changed by the handler"
+}
+
+func (h *kwargHandler) Get(args ...string) {
+	h.Write([]byte(h.user))
+}
+
+// TestKwargsPerRequest checks the middlewares and the handlers change a
+// copy of the kwargs of the route.
+func TestKwargsPerRequest(t *testing.T) {
+	kwargs := Dictionary{"user": "nobody"}
+	setUser := func(ctx *RouteContext, next func()) {
+		if user := ctx.Request.Request.URL.Query().Get("user"); len(user) != 0 {
+			ctx.Kwargs["user"] = user
+		}
+		next()
+	}
+	app := NewApplication()
+	app.Init([]UrlSpec{AddRouter("/", &kwargHandler{}, kwargs, "", setUser)},
+		map[string]interface{}{"CookieSecret": "secret"})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := fmt.Sprintf("user%d", i)
+			if _, body := serveGet(app, "/?user="+user); body != user {
+				t.Errorf("request of %s: %q", user, body)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if _, body := serveGet(app, "/"); body != "nobody" {
+		t.Errorf("request without user: %q", body)
+	}
+	if kwargs["user"] != "nobody" {
+		t.Errorf("kwargs of the route changed: %v", kwargs)
+	}
+}
@@ -0,0 +1,237 @@
+package lemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Prefork: with Processes set, Loop runs a master process which starts the
+// workers, the executable started again with LEMON_WORKER_ID. Every worker
+// binds the tcp addresses with SO_REUSEPORT and the kernel spreads the
+// connections among them, the unix and systemd sockets are opened by the
+// master and handed down like Restart does. The master restarts a worker
+// which exits, waiting longer each time it crashes again soon, and passes
+// the signals on to the workers.
+const envWorkerID = "LEMON_WORKER_ID"
+
+const (
+	workerRestartMin = time.Second      // wait before restarting a crashed worker
+	workerRestartMax = time.Minute      // the wait doubles up to workerRestartMax
+	workerStableTime = 30 * time.Second // a worker running that long resets the wait
+)
+
+// WorkerID returns the number of the worker process, from 0 to Processes-1,
+// or -1 if the process is not a worker.
+func (lem *Lemon) WorkerID() int {
+	return workerID()
+}
+
+func workerID() int {
+	id, err := strconv.Atoi(os.Getenv(envWorkerID))
+	if err != nil {
+		return -1
+	}
+	return id
+}
+
+// prefork reports whether this process is the master of the workers.
+func (lem *Lemon) prefork() bool {
+	return lem.app.Processes != 0 && workerID() < 0
+}
+
+// worker is a running worker process.
+type worker struct {
+	id      int
+	process *os.Process
+	started time.Time
+}
+
+// workerExit is sent when a worker process exits.
+type workerExit struct {
+	worker *worker
+	err    error
+}
+
+// runWorkers starts the workers and supervises them until SIGINT or
+// SIGTERM, which shuts them down. SIGHUP is passed on to them and the
+// restart signal SIGUSR2 replaces them one by one, each new worker serving
+// before the old one is shut down. It returns an error if a worker cannot
+// start the first time.
+func (lem *Lemon) runWorkers() error {
+	if !preforkSupported {
+		return errors.New(fmt.Sprintf("Processes is not supported on %s", runtime.GOOS))
+	}
+	count := lem.app.Processes
+	if count < 0 {
+		count = runtime.NumCPU()
+	}
+	if err := lem.openSharedListeners(); err != nil {
+		return err
+	}
+	files, names, err := lem.listenerFiles()
+	if err != nil {
+		lem.closeListeners()
+		return err
+	}
+	defer closeFiles(files)
+
+	workers := make([]*worker, count)
+	exits := make(chan workerExit, count)
+	start := func(id int) error {
+		process, err := startProcess("", files, names, []string{fmt.Sprintf("%s=%d", envWorkerID, id)}, workerProcAttr())
+		if err != nil {
+			return errors.New(fmt.Sprintf("worker %d: %v", id, err))
+		}
+		w := &worker{id: id, process: process, started: time.Now()}
+		workers[id] = w
+		lemonLag.Info(fmt.Sprintf("worker %d (pid %d) is serving", id, process.Pid))
+		go func() {
+			state, err := process.Wait()
+			if err == nil && !state.Success() {
+				err = errors.New(state.String())
+			}
+			exits <- workerExit{w, err}
+		}()
+		return nil
+	}
+	// stop shuts the workers down and waits for them
+	stop := func(sig os.Signal) {
+		running := 0
+		for _, w := range workers {
+			if w != nil {
+				w.process.Signal(sig)
+				running++
+			}
+		}
+		for running > 0 {
+			exit := <-exits
+			if workers[exit.worker.id] == exit.worker {
+				workers[exit.worker.id] = nil
+				running--
+			}
+		}
+		lem.closeListeners()
+	}
+
+	signals := make(chan os.Signal, 1)
+	notified := []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+	if restartSignal != nil {
+		notified = append(notified, restartSignal)
+	}
+	signal.Notify(signals, notified...)
+	defer signal.Stop(signals)
+
+	for id := range workers {
+		if err := start(id); err != nil {
+			stop(syscall.SIGTERM)
+			return err
+		}
+	}
+
+	delays := make([]time.Duration, count)
+	restarts := make(chan int, count)
+	for {
+		select {
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGHUP:
+				lemonLag.Info(fmt.Sprintf("Received %v, passing it on to the workers", sig))
+				for _, w := range workers {
+					if w != nil {
+						w.process.Signal(sig)
+					}
+				}
+			case restartSignal:
+				lemonLag.Info(fmt.Sprintf("Received %v, restarting the workers", sig))
+				lem.restartWorkers(workers, start)
+			default:
+				lemonLag.Info(fmt.Sprintf("Received %v, shutting down the workers", sig))
+				signal.Stop(signals)
+				stop(syscall.SIGTERM)
+				return lem.Shutdown()
+			}
+		case exit := <-exits:
+			w := exit.worker
+			if workers[w.id] != w {
+				// replaced by restartWorkers
+				continue
+			}
+			id := w.id
+			workers[id] = nil
+			if time.Since(w.started) > workerStableTime {
+				delays[id] = 0
+			}
+			delays[id] = nextRestartDelay(delays[id])
+			lemonLag.Error(fmt.Sprintf("worker %d (pid %d) exited: %v, restarting it in %v", id, w.process.Pid, exit.err, delays[id]))
+			time.AfterFunc(delays[id], func() { restarts <- id })
+		case id := <-restarts:
+			if workers[id] != nil {
+				continue
+			}
+			if err := start(id); err != nil {
+				delays[id] = nextRestartDelay(delays[id])
+				lemonLag.Error(fmt.Sprintf("%v, restarting it in %v", err, delays[id]))
+				time.AfterFunc(delays[id], func() { restarts <- id })
+			}
+		}
+	}
+}
+
+// nextRestartDelay doubles the wait before restarting a worker, from
+// workerRestartMin up to workerRestartMax.
+func nextRestartDelay(delay time.Duration) time.Duration {
+	if delay < workerRestartMin {
+		return workerRestartMin
+	}
+	if delay *= 2; delay > workerRestartMax {
+		return workerRestartMax
+	}
+	return delay
+}
+
+// restartWorkers replaces the workers one by one, the old worker is shut
+// down once the new one serves. A worker which cannot start is logged and
+// the old one keeps serving.
+func (lem *Lemon) restartWorkers(workers []*worker, start func(int) error) {
+	for id, old := range workers {
+		if err := start(id); err != nil {
+			lemonLag.Error(fmt.Sprintf("%v, keeping the old one", err))
+			continue
+		}
+		if old != nil {
+			old.process.Signal(syscall.SIGTERM)
+		}
+	}
+}
+
+// openSharedListeners opens the unix and systemd listeners in the master,
+// the workers share them. The tcp addresses are bound by every worker.
+func (lem *Lemon) openSharedListeners() error {
+	for _, config := range lem.listenConfigs {
+		var err error
+		switch config.network {
+		case "unix":
+			_, err = lem.listenUnix(config.address, config.mode, config.owner)
+		case "systemd":
+			_, err = lem.listenSystemd(config.names)
+		}
+		if err != nil {
+			lem.closeListeners()
+			return err
+		}
+	}
+	return nil
+}
+
+func (lem *Lemon) closeListeners() {
+	for _, l := range lem.listeners {
+		l.Close()
+	}
+	lem.listeners = nil
+}
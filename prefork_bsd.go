@@ -0,0 +1,26 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package lemon
+
+import (
+	"syscall"
+)
+
+const preforkSupported = true
+
+// reusePort sets SO_REUSEPORT on a listening socket, so every worker binds
+// the same address.
+func reusePort(network, address string, conn syscall.RawConn) error {
+	var err error
+	conn.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEPORT, 1)
+	})
+	return err
+}
+
+// workerProcAttr puts a worker in its own process group, so a Ctrl-C only
+// reaches the master which shuts the workers down.
+func workerProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
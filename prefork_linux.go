@@ -0,0 +1,24 @@
+package lemon
+
+import (
+	"syscall"
+)
+
+const preforkSupported = true
+
+// reusePort sets SO_REUSEPORT on a listening socket, so every worker binds
+// the same address and the kernel spreads the connections among them.
+func reusePort(network, address string, conn syscall.RawConn) error {
+	var err error
+	conn.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	return err
+}
+
+// workerProcAttr puts a worker in its own process group, so a Ctrl-C only
+// reaches the master which shuts the workers down, and makes the kernel
+// send it SIGTERM if the master dies.
+func workerProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGTERM}
+}
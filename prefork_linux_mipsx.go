@@ -0,0 +1,8 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+// +build linux
+// +build mips mipsle mips64 mips64le
+
+package lemon
+
+// soReusePort is SO_REUSEPORT of linux on mips, which package syscall lacks.
+const soReusePort = 0x200
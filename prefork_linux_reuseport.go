@@ -0,0 +1,7 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package lemon
+
+// soReusePort is SO_REUSEPORT of linux, which package syscall lacks.
+const soReusePort = 0xf
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package lemon
+
+import (
+	"errors"
+	"syscall"
+)
+
+// preforkSupported is false where SO_REUSEPORT is missing.
+const preforkSupported = false
+
+func reusePort(network, address string, conn syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported")
+}
+
+func workerProcAttr() *syscall.SysProcAttr {
+	return nil
+}
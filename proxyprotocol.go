@@ -0,0 +1,255 @@
+package lemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The PROXY protocol lets a TCP load balancer pass the address of the
+// client before the data of the connection, see
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+const (
+	proxyV1MaxLength  = 107 // including the CRLF
+	proxyV2HeaderSize = 16
+)
+
+// proxyHeaderTimeOut is the time a trusted peer has to send its header.
+var proxyHeaderTimeOut = 10 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// initProxyProtocol parses the networks of ProxyProtocol.
+func (app *Application) initProxyProtocol() {
+	app.proxyNetworks = nil
+	for _, cidr := range app.ProxyProtocol {
+		network, err := parseNetwork(cidr)
+		if err != nil {
+			errLog := fmt.Sprintf("invalid ProxyProtocol network %s: %v", cidr, err)
+			lemonLag.Error(errLog)
+			panic(errLog)
+		}
+		app.proxyNetworks = append(app.proxyNetworks, network)
+	}
+}
+
+// parseNetwork parses a CIDR, or a single IP address.
+func parseNetwork(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, errors.New("not an IP address or a CIDR")
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	return network, err
+}
+
+// proxyListener reads the PROXY protocol header of the connections
+// accepted from the trusted networks.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func newProxyListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyListener{Listener: l, trusted: trusted}
+}
+
+// Accept returns the connections without waiting for the header, it is
+// read by the goroutine serving the connection.
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !pl.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// trusts reports whether addr may send a PROXY protocol header, the peers
+// of a unix socket are local processes and are trusted.
+func (pl *proxyListener) trusts(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	for _, network := range pl.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection starting with a PROXY protocol header. The
+// header is required, a connection without a valid one fails on its first
+// read.
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr // sent by the load balancer, nil for a LOCAL or UNKNOWN connection
+	localAddr  net.Addr
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	pc.once.Do(pc.readHeader)
+	if pc.err != nil {
+		return 0, pc.err
+	}
+	return pc.reader.Read(b)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.once.Do(pc.readHeader)
+	if pc.remoteAddr != nil {
+		return pc.remoteAddr
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+func (pc *proxyConn) LocalAddr() net.Addr {
+	pc.once.Do(pc.readHeader)
+	if pc.localAddr != nil {
+		return pc.localAddr
+	}
+	return pc.Conn.LocalAddr()
+}
+
+func (pc *proxyConn) readHeader() {
+	pc.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeOut))
+	defer pc.Conn.SetReadDeadline(time.Time{})
+	first, err := pc.reader.Peek(1)
+	if err == nil {
+		switch first[0] {
+		case 'P':
+			err = pc.readV1()
+		case proxyV2Signature[0]:
+			err = pc.readV2()
+		default:
+			err = errors.New("no PROXY protocol header")
+		}
+	}
+	if err != nil {
+		pc.err = errors.New(fmt.Sprintf("PROXY protocol from %s: %v", pc.Conn.RemoteAddr(), err))
+		lemonLag.Warning(pc.err.Error())
+	}
+}
+
+// readV1 reads a header "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func (pc *proxyConn) readV1() error {
+	line := []byte{}
+	for {
+		b, err := pc.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return errors.New("header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("header not ended by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return errors.New("invalid v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return errors.New("invalid v1 header")
+	}
+	remote, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	local, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	pc.remoteAddr, pc.localAddr = remote, local
+	return nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New(fmt.Sprintf("invalid address %s", host))
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid port %s", port))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 reads a binary header, the addresses of an AF_INET or AF_INET6
+// PROXY command are used and the TLVs are skipped.
+func (pc *proxyConn) readV2() error {
+	header := make([]byte, proxyV2HeaderSize)
+	if _, err := io.ReadFull(pc.reader, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:len(proxyV2Signature)], proxyV2Signature) {
+		return errors.New("invalid v2 signature")
+	}
+	if header[12]>>4 != 2 {
+		return errors.New(fmt.Sprintf("unsupported version %d", header[12]>>4))
+	}
+	command, family := header[12]&0x0f, header[13]>>4
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(pc.reader, payload); err != nil {
+		return err
+	}
+	switch command {
+	case 0x0: // LOCAL, e.g. a health check of the load balancer
+		return nil
+	case 0x1: // PROXY
+	default:
+		return errors.New(fmt.Sprintf("unknown v2 command %d", command))
+	}
+	size := 0
+	switch family {
+	case 0x1: // AF_INET
+		size = net.IPv4len
+	case 0x2: // AF_INET6
+		size = net.IPv6len
+	default: // AF_UNSPEC or AF_UNIX, the real addresses are kept
+		return nil
+	}
+	if len(payload) < 2*size+4 {
+		return errors.New("v2 addresses too short")
+	}
+	pc.remoteAddr = &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	pc.localAddr = &net.TCPAddr{
+		IP:   net.IP(payload[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+	return nil
+}
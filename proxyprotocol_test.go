@@ -0,0 +1,182 @@
+package lemon
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 returns a v2 header of command and family, followed by payload.
+func proxyV2(version, command, family byte, payload ...[]byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, version<<4|command, family<<4|0x1, 0, 0)
+	for _, p := range payload {
+		header = append(header, p...)
+	}
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(header)-proxyV2HeaderSize))
+	return header
+}
+
+// proxyV2Addresses returns the addresses of a v2 PROXY command.
+func proxyV2Addresses(remote, local string, remotePort, localPort uint16) []byte {
+	remoteIP, localIP := net.ParseIP(remote), net.ParseIP(local)
+	if ip4 := remoteIP.To4(); ip4 != nil {
+		remoteIP, localIP = ip4, localIP.To4()
+	}
+	addresses := append(append([]byte{}, remoteIP...), localIP...)
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(addresses, remotePort), localPort)
+}
+
+// proxyTLVs is an authority and a unique id TLV.
+var proxyTLVs = []byte{0x02, 0, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x05, 0, 2, 0xab, 0xcd}
+
+// readProxyConn sends data on a pipe read as a proxyConn, the writer is
+// closed after it. It returns the addresses and what was read after the
+// header.
+func readProxyConn(data []byte) (remote, local, read string, err error) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	pc := &proxyConn{Conn: server, reader: bufio.NewReader(server)}
+	content, err := io.ReadAll(pc)
+	return pc.RemoteAddr().String(), pc.LocalAddr().String(), string(content), err
+}
+
+func TestProxyConn(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		remote string
+		local  string
+		fails  bool
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"), "192.0.2.1:56324", "192.0.2.2:443", false},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324", "[2001:db8::2]:443", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "pipe", "pipe", false},
+		{"v1 UNKNOWN with addresses", []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), "pipe", "pipe", false},
+		{"v1 longest", []byte("PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe 65535 65534\r\n"),
+			"[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535", "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe]:65534", false},
+		{"v1 too long", []byte("PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe 0000065535 0000065534\r\n"), "", "", true},
+		{"v1 without CRLF", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n"), "", "", true},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1 192."), "", "", true},
+		{"v1 missing port", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n"), "", "", true},
+		{"v1 invalid port", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 65536 443\r\n"), "", "", true},
+		{"v1 invalid address", []byte("PROXY TCP4 192.0.2 192.0.2.2 56324 443\r\n"), "", "", true},
+		{"v1 unknown protocol", []byte("PROXY UDP4 192.0.2.1 192.0.2.2 56324 443\r\n"), "", "", true},
+		{"v1 lowercase", []byte("proxy TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"), "", "", true},
+		{"v2 PROXY TCP4", proxyV2(2, 1, 1, proxyV2Addresses("192.0.2.1", "192.0.2.2", 56324, 443)),
+			"192.0.2.1:56324", "192.0.2.2:443", false},
+		{"v2 PROXY TCP4 with TLVs", proxyV2(2, 1, 1, proxyV2Addresses("192.0.2.1", "192.0.2.2", 56324, 443), proxyTLVs),
+			"192.0.2.1:56324", "192.0.2.2:443", false},
+		{"v2 PROXY TCP6 with TLVs", proxyV2(2, 1, 2, proxyV2Addresses("2001:db8::1", "2001:db8::2", 56324, 443), proxyTLVs),
+			"[2001:db8::1]:56324", "[2001:db8::2]:443", false},
+		{"v2 PROXY unix", proxyV2(2, 1, 3, make([]byte, 216)), "pipe", "pipe", false},
+		{"v2 LOCAL", proxyV2(2, 0, 0), "pipe", "pipe", false},
+		{"v2 LOCAL with TLVs", proxyV2(2, 0, 1, proxyV2Addresses("192.0.2.1", "192.0.2.2", 56324, 443), proxyTLVs), "pipe", "pipe", false},
+		{"v2 truncated header", proxyV2(2, 1, 1)[:10], "", "", true},
+		{"v2 truncated payload", proxyV2(2, 1, 1, proxyV2Addresses("192.0.2.1", "192.0.2.2", 56324, 443))[:20], "", "", true},
+		{"v2 addresses too short", proxyV2(2, 1, 2, proxyV2Addresses("192.0.2.1", "192.0.2.2", 56324, 443)), "", "", true},
+		{"v2 bad signature", append([]byte("\r\n\r\n\x00\r\nquit\n"), proxyV2(2, 1, 1, proxyV2Addresses("192.0.2.1", "192.0.2.2", 1, 2))[12:]...), "", "", true},
+		{"v2 version 1", proxyV2(1, 1, 1, proxyV2Addresses("192.0.2.1", "192.0.2.2", 56324, 443)), "", "", true},
+		{"v2 unknown command", proxyV2(2, 2, 1, proxyV2Addresses("192.0.2.1", "192.0.2.2", 56324, 443)), "", "", true},
+		{"no header", []byte("GET / HTTP/1.1\r\n"), "", "", true},
+		{"empty", nil, "", "", true},
+	}
+	for _, test := range tests {
+		remote, local, read, err := readProxyConn(append(test.header, "hello"...))
+		if test.fails {
+			if err == nil || !strings.Contains(err.Error(), "PROXY protocol") || len(read) != 0 {
+				t.Errorf("%s: read %q, %v", test.name, read, err)
+			}
+			continue
+		}
+		if err != nil || read != "hello" || remote != test.remote || local != test.local {
+			t.Errorf("%s: %s %s %q %v, want %s %s", test.name, remote, local, read, err, test.remote, test.local)
+		}
+	}
+}
+
+func TestProxyConnReadDeadline(t *testing.T) {
+	defer func(timeOut time.Duration) { proxyHeaderTimeOut = timeOut }(proxyHeaderTimeOut)
+	proxyHeaderTimeOut = 50 * time.Millisecond
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	pc := &proxyConn{Conn: server, reader: bufio.NewReader(server)}
+	done := make(chan error, 1)
+	go func() {
+		_, err := pc.Read(make([]byte, 10))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "timeout") {
+			t.Errorf("without header: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the header is waited for after proxyHeaderTimeOut")
+	}
+
+	// the deadline is cleared once the header is read
+	client, server = net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	pc = &proxyConn{Conn: server, reader: bufio.NewReader(server)}
+	go func() {
+		client.Write([]byte("PROXY UNKNOWN\r\n"))
+		time.Sleep(4 * proxyHeaderTimeOut)
+		client.Write([]byte("hello"))
+	}()
+	content := make([]byte, 5)
+	if _, err := io.ReadFull(pc, content); err != nil || string(content) != "hello" {
+		t.Errorf("after the header: %q %v", content, err)
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		trusted string
+		remote  string
+		read    string
+	}{
+		{"trusted", "127.0.0.0/8", "192.0.2.1:56324", "hello"},
+		{"untrusted", "10.0.0.0/8", "127.0.0.1", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nhello"},
+	} {
+		network, _ := parseNetwork(test.trusted)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl := newProxyListener(l, []*net.IPNet{network})
+		go func() {
+			client, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return
+			}
+			client.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nhello"))
+			client.Close()
+		}()
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(conn)
+		remote := conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(remote); err == nil && test.name == "untrusted" {
+			remote = host
+		}
+		if err != nil || string(content) != test.read || remote != test.remote {
+			t.Errorf("%s: %s %q %v", test.name, remote, content, err)
+		}
+		conn.Close()
+		pl.Close()
+	}
+}
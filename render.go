@@ -0,0 +1,75 @@
+package lemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// renderWriter streams a template rendered by Render to the response. The
+// first RenderBufferSize bytes are held, so an error of the template until
+// then still gives an error page; past them the response is started and
+// the rest is written through, compressed like Write does.
+type renderWriter struct {
+	rh      *RequestHandler
+	limit   int // RenderBufferSize, -1 holds the whole page
+	buffer  bytes.Buffer
+	started bool
+	written int // bytes written since the response started
+}
+
+func (w *renderWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		if w.limit < 0 || w.buffer.Len()+len(p) <= w.limit {
+			return w.buffer.Write(p)
+		}
+		w.started = true
+		if w.buffer.Len() != 0 {
+			if err := w.rh.write(w.buffer.Bytes()); err != nil {
+				return 0, err
+			}
+			w.written += w.buffer.Len()
+			w.buffer.Reset()
+		}
+	}
+	// an error stops the template, e.g. the client is gone
+	if err := w.rh.write(p); err != nil {
+		return 0, err
+	}
+	w.written += len(p)
+	return len(p), nil
+}
+
+// finish writes the page held if the response did not start.
+func (w *renderWriter) finish() {
+	if !w.started {
+		w.rh.Write(w.buffer.Bytes())
+	}
+}
+
+// fail handles the error of the template, the request fails with 404 if it
+// does not exist and 500 otherwise. Once the response started the status is
+// sent already, the connection is closed so the client does not take the
+// page for a complete one.
+func (w *renderWriter) fail(templateName string, err error) {
+	if !w.started {
+		w.rh.renderError(templateName, err)
+	}
+	lemonLag.Error(fmt.Sprintf("template %s failed after %d bytes were sent: %v", templateName, w.written, err))
+	w.rh.Status = 500
+	// the compressed stream is left incomplete too
+	w.rh.compressor = nil
+	panic(http.ErrAbortHandler)
+}
+
+// renderError fails the request with the error of the engine rendering
+// templateName.
+func (rh *RequestHandler) renderError(templateName string, err error) {
+	if errors.Is(err, ErrTemplateNotFound) {
+		rh.Status = 404
+		panic("no this template: " + templateName)
+	}
+	rh.Status = 500
+	panic(err.Error())
+}
@@ -4,15 +4,12 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
-	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/base64"
 	"fmt"
 	"github.com/ouyangshangwen/lemon/utils"
 	"html/template"
 	"io"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"reflect"
 	"runtime/debug"
 	"strconv"
@@ -47,6 +44,7 @@ type HandlerInterface interface {
 	SetDefaultHeaders()
 	FunctionsMap() map[string]interface{}
 	CheckXsrfCookie() bool
+	GetCurrentUser() interface{}
 }
 
 type RequestHandler struct {
@@ -60,6 +58,10 @@ type RequestHandler struct {
 	delegate       HandlerInterface
 	RaiseError     bool
 	Expires        int
+	currentUser    interface{}
+	hasCurrentUser bool
+	session        *Session
+	compressor     io.WriteCloser // compresses the response started by Write, closed once the handler returns
 }
 
 
@@ -167,9 +169,31 @@ func (rh *RequestHandler) _getQueryArguments(name string) []string {
 	}
 }
 
-//Alias for `Application.ReverseUrl`
+//Returns the named path parameter ``name`` of the url pattern,
+//as it appears in the url.
+//
+//If the parameter is not present, return an empty string
+func (rh *RequestHandler) GetPathArgument(name string) string {
+	return rh.Request.PathArguments[name]
+}
+
+//Returns the named path parameter ``name`` of the url pattern,
+//converted by its `Converter`, e.g. an int for ``{id:int}``.
+//
+//If the parameter is not present, return nil
+func (rh *RequestHandler) GetPathValue(name string) interface{} {
+	return rh.Request.PathValues[name]
+}
+
+//Alias for `Application.ReverseUrl`, the url is prefixed by the path
+//the application is mounted on, see `HttpRequest.ScriptName`
 func (rh *RequestHandler) ReverseUrl(name string, params ...string) string {
-	return rh.application.ReverseUrl(name, params...)
+	return rh.application.reverseUrl(rh.Request.ScriptName, name, params...)
+}
+
+//Alias for `Application.ReverseUrlKwargs`, the url is prefixed like `ReverseUrl`
+func (rh *RequestHandler) ReverseUrlKwargs(name string, kwargs Dictionary) string {
+	return rh.application.reverseUrlKwargs(rh.Request.ScriptName, name, kwargs)
 }
 
 func (rh *RequestHandler) GetContentType() string {
@@ -214,6 +238,80 @@ func (rh *RequestHandler) Finish() {
 
 }
 
+//Override to determine the current user from, e.g., a cookie.
+//
+//It is called at most once per request, by CurrentUser, a nil value
+//means that no user is logged in.
+func (rh *RequestHandler) GetCurrentUser() interface{} {
+	return nil
+}
+
+//Returns the authenticated user of this request, as returned by
+//GetCurrentUser and cached for the rest of the request.
+func (rh *RequestHandler) CurrentUser() interface{} {
+	if !rh.hasCurrentUser {
+		rh.currentUser = rh.delegate.GetCurrentUser()
+		rh.hasCurrentUser = true
+	}
+	return rh.currentUser
+}
+
+//Sets the current user of this request, e.g. after a login in Post.
+//
+//Unless it sets the user already returned by CurrentUser, the session is
+//regenerated, so an id known before the login can't be used after it.
+func (rh *RequestHandler) SetCurrentUser(user interface{}) {
+	changed := !rh.hasCurrentUser || !reflect.DeepEqual(rh.currentUser, user)
+	if changed && rh.hasSession() {
+		rh.Session().Regenerate()
+	}
+	rh.currentUser = user
+	rh.hasCurrentUser = true
+}
+
+//Returns the session of this request, loaded from the ``SessionStore``
+//on first use. It is saved when the headers are written or the request
+//finishes, call ``Session().Regenerate()`` when a user logs in.
+func (rh *RequestHandler) Session() *Session {
+	if rh.session == nil {
+		rh.session = rh.loadSession()
+	}
+	return rh.session
+}
+
+//Returns the url unauthenticated users are redirected to,
+//the ``LoginUrl`` setting.
+func (rh *RequestHandler) GetLoginUrl() string {
+	return rh.application.LoginUrl
+}
+
+//Stops the request if the handler requires a logged in user, see the
+//``authenticated`` tag, and there is none.
+//
+//Unauthenticated GET and HEAD requests are redirected to `GetLoginUrl`
+//with the ``next`` argument, other methods, ajax requests, handlers
+//tagged ``api:"true"`` or an empty ``LoginUrl`` get a 403.
+func (rh *RequestHandler) checkAuthenticated() {
+	handlerType := reflect.Indirect(reflect.ValueOf(rh.delegate)).Type()
+	requirement := handlerAuthRequirement(handlerType)
+	if !requirement.requires(rh.Request.Method()) || !isNilUser(rh.CurrentUser()) {
+		return
+	}
+	loginUrl := rh.GetLoginUrl()
+	method := rh.Request.Method()
+	if requirement.api || rh.Request.IsAjax() || len(loginUrl) == 0 ||
+		(method != "GET" && method != "HEAD") {
+		rh.RaiseHttpError(403, "Forbidden")
+	}
+	next := rh.Request.pathUri()
+	if parsed, err := url.Parse(loginUrl); err == nil && parsed.IsAbs() {
+		next = rh.Request.Scheme() + "://" + rh.Request.Host() + next
+	}
+	rh.Redirect(addNextArgument(loginUrl, next), 302)
+	rh.RaiseError = true
+	panic("redirect to login url")
+}
+
 //Resets all headers and content for this response
 func (rh *RequestHandler) Clear() {
 	rh.SetHeader("Server", rh.application.ServerName)
@@ -250,49 +348,82 @@ func (rh *RequestHandler) SetDefaultHeaders() {
 
 }
 
+//Serves HEAD by running Get and dropping the body, override it to serve
+//HEAD differently.
 func (rh *RequestHandler) Head(args ...string) {
-	http.Error(rh.ResponseWriter, "Method Not Allowed", 405)
+	if !rh.isMethodAllowed("GET") {
+		rh.methodNotAllowed()
+	}
+	rw := rh.ResponseWriter
+	rh.ResponseWriter = headResponseWriter{rw}
+	defer func() {
+		rh.ResponseWriter = rw
+	}()
+	rh.delegate.Get(args...)
 }
 
 func (rh *RequestHandler) Put(args ...string) {
-	//http.Error(rh.ResponseWriter, "Method Not Allowed", 405)
-	rh.Status = 405
-	panic("Method Not Allowed")
+	rh.methodNotAllowed()
 }
 
 func (rh *RequestHandler) Post(args ...string) {
-	//http.Error(rh.ResponseWriter, "Method Not Allowed", 405)
-	rh.Status = 405
-	panic("Method Not Allowed")
+	rh.methodNotAllowed()
 }
 
 func (rh *RequestHandler) Get(args ...string) {
-	//http.Error(rh.ResponseWriter, "Method Not Allowed", 405)
-	rh.Status = 405
-	panic("Method Not Allowed")
+	rh.methodNotAllowed()
 }
 
 func (rh *RequestHandler) Patch(args ...string) {
-	//http.Error(rh.ResponseWriter, "Method Not Allowed", 405)
-	rh.Status = 405
-	panic("Method Not Allowed")
+	rh.methodNotAllowed()
 }
 
+//Answers OPTIONS with the methods of the handler in the ``Allow`` header.
 func (rh *RequestHandler) Options(args ...string) {
-	//http.Error(rh.ResponseWriter, "Method Not Allowed", 405)
-	rh.Status = 405
-	panic("Method Not Allowed")
+	rh.SetHeader("Allow", strings.Join(rh.AllowedMethods(), ", "))
+	rh.SetHeader("Content-Length", "0")
+	rh.Status = 204
+	rh.WriteHeader(rh.Status)
 }
 
 func (rh *RequestHandler) Delete(args ...string) {
-	//http.Error(rh.ResponseWriter, "Method Not Allowed", 405)
+	rh.methodNotAllowed()
+}
+
+//Returns the HTTP methods answered by the handler: the ones whose
+//method (Get, Post, ...) it overrides, HEAD if it overrides Get, and
+//OPTIONS.
+func (rh *RequestHandler) AllowedMethods() []string {
+	return allowedMethods(reflect.Indirect(reflect.ValueOf(rh.delegate)).Type())
+}
+
+func (rh *RequestHandler) isMethodAllowed(method string) bool {
+	for _, allowed := range rh.AllowedMethods() {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (rh *RequestHandler) methodNotAllowed() {
+	rh.SetHeader("Allow", strings.Join(rh.AllowedMethods(), ", "))
 	rh.Status = 405
-	panic("Method Not Allowed")
+	rh.RaiseHttpError(405, "Method Not Allowed")
 }
 
 // GetSecureCookie returns decoded cookie value from encoded browser cookie values.
+//
+// The cookie must be signed with one of the ``CookieSecret`` keys for this
+// name, and be at most ``CookieMaxAge`` seconds old.
 func (rh *RequestHandler) GetSecureCookie(key string) string {
-	secureCookie, ok := rh.getSecureCookie(key)
+	return rh.GetSecureCookieMaxAge(key, rh.application.CookieMaxAge)
+}
+
+// GetSecureCookieMaxAge is like GetSecureCookie with a maximal age of
+// maxAge seconds instead of ``CookieMaxAge``.
+func (rh *RequestHandler) GetSecureCookieMaxAge(key string, maxAge int) string {
+	secureCookie, ok := rh.getSecureCookie(key, maxAge)
 	if ok {
 		return secureCookie
 	} else {
@@ -302,14 +433,29 @@ func (rh *RequestHandler) GetSecureCookie(key string) string {
 
 // Set Secure cookie for response.
 func (rh *RequestHandler) SetSecureCookie(name, value string, others map[string]interface{}) {
-	secret := rh.application.CookieSecret
-	if len(secret) == 0 {
-		secret = "cookive secret"
-	}
-	cookie := rh.createdSignedValue(secret, name, value)
+	cookie := rh.CreateSignedValue(name, value)
 	rh.SetCookie(name, cookie, others)
 }
 
+// CreateSignedValue signs and timestamps value for the cookie name with
+// the ``CookieKeyVersion`` key of ``CookieSecret``, the way SetSecureCookie
+// does, to be read back by DecodeSignedValue.
+func (rh *RequestHandler) CreateSignedValue(name, value string) string {
+	keyVersion := rh.application.CookieKeyVersion
+	secret := rh.application.CookieSecrets[keyVersion]
+	return createSignedValue(secret, keyVersion, name, value, time.Now())
+}
+
+// DecodeSignedValue returns the value signed by CreateSignedValue for name,
+// or "" if it is invalid or older than maxAge seconds.
+func (rh *RequestHandler) DecodeSignedValue(name, value string, maxAge int) string {
+	decoded, err := decodeSignedValue(rh.application.CookieSecrets, name, value, maxAge, time.Now())
+	if err != nil {
+		return ""
+	}
+	return decoded
+}
+
 // Get cookie from request by a given key.
 // It's alias of HttpRequest.Cookie.
 func (rh *RequestHandler) GetCookie(key string) string {
@@ -379,34 +525,16 @@ func (rh *RequestHandler) setCookie(name string, value string, others map[string
 }
 
 // Get secure cookie from request by a given key.
-func (rh *RequestHandler) getSecureCookie(key string) (string, bool) {
-	secret := rh.application.CookieSecret
-	if len(secret) == 0 {
-		secret = "cookive secret"
-	}
+func (rh *RequestHandler) getSecureCookie(key string, maxAge int) (string, bool) {
 	val := rh.GetCookie(key)
 	if val == "" {
 		return "", false
 	}
-
-	parts := strings.SplitN(val, "|", 3)
-
-	if len(parts) != 3 {
-		return "", false
-	}
-
-	vs := parts[0]
-	timestamp := parts[1]
-	sig := parts[2]
-
-	h := hmac.New(sha1.New, []byte(secret))
-	fmt.Fprintf(h, "%s%s", vs, timestamp)
-
-	if fmt.Sprintf("%02x", h.Sum(nil)) != sig {
+	res, err := decodeSignedValue(rh.application.CookieSecrets, key, val, maxAge, time.Now())
+	if err != nil {
 		return "", false
 	}
-	res, _ := base64.URLEncoding.DecodeString(vs)
-	return string(res), true
+	return res, true
 }
 
 var cookieNameSanitizer = strings.NewReplacer("\n", "-", "\r", "-")
@@ -421,42 +549,9 @@ func sanitizeValue(v string) string {
 	return cookieValueSanitizer.Replace(v)
 }
 
-func (rh *RequestHandler) createdSignedValue(secret, name, value string) string {
-	vs := base64.URLEncoding.EncodeToString([]byte(value))
-	timestamp := strconv.FormatInt(time.Now().UnixNano(), 10)
-	h := hmac.New(sha1.New, []byte(secret))
-	fmt.Fprintf(h, "%s%s", vs, timestamp)
-	sig := fmt.Sprintf("%02x", h.Sum(nil))
-	cookie := strings.Join([]string{vs, timestamp, sig}, "|")
-	return cookie
-}
-
-func (rh *RequestHandler) decodeSignedValue(secret, value string) string {
-	if value == "" {
-		return ""
-	}
-
-	parts := strings.SplitN(value, "|", 3)
-
-	if len(parts) != 3 {
-		return ""
-	}
-
-	vs := parts[0]
-	timestamp := parts[1]
-	sig := parts[2]
-
-	h := hmac.New(sha1.New, []byte(secret))
-	fmt.Fprintf(h, "%s%s", vs, timestamp)
-
-	if fmt.Sprintf("%02x", h.Sum(nil)) != sig {
-		return ""
-	}
-	res, _ := base64.URLEncoding.DecodeString(vs)
-	return string(res)
-}
-
 func (rh *RequestHandler) WriteHeader(status int) {
+	// last chance to send the session cookie
+	rh.saveSession()
 	rh.WroteHeader = true
 	rh.ResponseWriter.WriteHeader(status)
 }
@@ -473,44 +568,57 @@ func (rh *RequestHandler) WriteStringOnly(message string) {
 }
 
 func (rh *RequestHandler) Write(content []byte) {
+	if err := rh.write(content); err != nil {
+		fmt.Println(err)
+	}
+}
 
+// write starts the response if needed and writes content, compressed if
+// IsGzip is set and the request accepts gzip or deflate.
+func (rh *RequestHandler) write(content []byte) error {
 	if !rh.WroteHeader {
+		rh.compressor = rh.compressedWriter()
 		rh.WriteHeader(rh.Status)
 	}
-	if rh.application.IsGzip == true && rh.Request.Header("Accept-Encoding") != "" {
-		output_writer := rh.ResponseWriter.(io.Writer)
-		splitted := strings.SplitN(rh.Request.Header("Accept-Encoding"), ",", -1)
-		encodings := make([]string, len(splitted))
-
-		for i, val := range splitted {
-			encodings[i] = strings.TrimSpace(val)
+	if rh.compressor != nil {
+		_, err := rh.compressor.Write(content)
+		return err
+	}
+	_, err := rh.ResponseWriter.Write(content)
+	return err
+}
+
+// compressedWriter sets the Content-Encoding of the response and returns
+// the writer compressing it, nil if IsGzip is off or the request accepts
+// neither gzip nor deflate.
+func (rh *RequestHandler) compressedWriter() io.WriteCloser {
+	if !rh.application.IsGzip || rh.Request.Header("Accept-Encoding") == "" {
+		return nil
+	}
+	for _, val := range strings.Split(rh.Request.Header("Accept-Encoding"), ",") {
+		switch strings.TrimSpace(val) {
+		case "gzip":
+			rh.SetHeader("Content-Encoding", "gzip")
+			rh.ResponseWriter.Header().Del("Content-Length")
+			output_writer, _ := gzip.NewWriterLevel(rh.ResponseWriter, gzip.BestSpeed)
+			return output_writer
+		case "deflate":
+			rh.SetHeader("Content-Encoding", "deflate")
+			rh.ResponseWriter.Header().Del("Content-Length")
+			output_writer, _ := flate.NewWriter(rh.ResponseWriter, flate.BestSpeed)
+			return output_writer
 		}
-		for _, val := range encodings {
-			if val == "gzip" {
-				rh.SetHeader("Content-Encoding", "gzip")
-				output_writer, _ = gzip.NewWriterLevel(rh.ResponseWriter, gzip.BestSpeed)
-				defer output_writer.(*gzip.Writer).Close()
-				break
-			} else if val == "deflate" {
-				rh.SetHeader("Content-Encoding", "deflate")
-				output_writer, _ = flate.NewWriter(rh.ResponseWriter, flate.BestSpeed)
-				defer output_writer.(*flate.Writer).Close()
-				break
-			}
-
-			_, err := output_writer.Write(content)
-			if err != nil {
-				fmt.Println(err)
-			}
-			return
-		}
-	} else {
-
-		rh.SetHeader("Content-Length", strconv.Itoa(len(content)))
-		rh.ResponseWriter.Write(content)
-		return
 	}
+	return nil
+}
 
+// closeCompressor flushes the compressed response once the handler
+// returned.
+func (rh *RequestHandler) closeCompressor() {
+	if rh.compressor != nil {
+		rh.compressor.Close()
+		rh.compressor = nil
+	}
 }
 
 func (rh *RequestHandler) WriteString(str string) {
@@ -518,47 +626,78 @@ func (rh *RequestHandler) WriteString(str string) {
 	rh.ResponseWriter.Write([]byte(str))
 }
 
+// Render executes the template with the engine of its extension and
+// streams the page to the response, see RenderBufferSize. The templates of
+// no engine, and all of them if the handler overrides RenderByte, are
+// rendered by RenderByte.
 func (rh *RequestHandler) Render(templateName string, context map[string]interface{}) {
-	html := rh.delegate.RenderByte(templateName, context)
-	rh.Write(html)
-	//fmt.Println(html)
-
+	engine := rh.application.templateEngine(templateName)
+	if engine == nil || overridesMethod(reflect.Indirect(reflect.ValueOf(rh.delegate)).Type(), "RenderByte") {
+		html := rh.delegate.RenderByte(templateName, context)
+		rh.Write(html)
+		return
+	}
+	w := &renderWriter{rh: rh, limit: rh.application.RenderBufferSize}
+	err := engine.Render(w, templateName, rh.templateContext(context), rh.delegate.FunctionsMap())
+	if err != nil {
+		w.fail(templateName, err)
+	}
+	w.finish()
 }
 
+// RenderByte renders the template with the engine of its extension, see
+// Application.TemplateEngines. The request fails with 404 if the template
+// does not exist and 500 if it cannot be parsed or executed.
 func (rh *RequestHandler) RenderByte(templateName string, context map[string]interface{}) []byte {
 
-	if rh.application.IsCustomedTemplate {
+	engine := rh.application.templateEngine(templateName)
+	if engine == nil {
 		rh.Status = 500
-		panic("if `Application.IsCustomedTemplate is true`, must overwrite the method of RenderByte ")
+		panic("no template engine renders " + templateName + ", register one in `Application.TemplateEngines` or overwrite the method of RenderByte")
 	}
-	namespace := rh.GetTemplateNamespace()
-	for key, value := range namespace {
-		context[key] = value
-	}
-
-	template := rh.CreateTemplateLoader(templateName)
 	newbytes := bytes.NewBufferString("")
-
-	err := template.ExecuteTemplate(newbytes, templateName, context)
-	if err != nil {
-		lemonLag.Info(err)
-	}
-	content, err := ioutil.ReadAll(newbytes)
+	err := engine.Render(newbytes, templateName, rh.templateContext(context), rh.delegate.FunctionsMap())
 	if err != nil {
+		rh.renderError(templateName, err)
 	}
-	return content
+	return newbytes.Bytes()
+
+}
 
+// templateContext adds the namespace of GetTemplateNamespace to context.
+func (rh *RequestHandler) templateContext(context map[string]interface{}) map[string]interface{} {
+	namespace := rh.GetTemplateNamespace()
+	for key, value := range namespace {
+		context[key] = value
+	}
+	return context
 }
 
+// CreateTemplateLoader returns the template templateName of Templates, with
+// the functions of FunctionsMap it is a new clone on every call, which the
+// caller owns and the other requests never share.
 func (rh *RequestHandler) CreateTemplateLoader(templateName string) *template.Template {
-	template, ok := Templates.Templates[templateName]
+	template, ok := Templates.Lookup(templateName)
 	if !ok {
+		if err := Templates.Error(templateName); err != nil {
+			rh.Status = 500
+			panic(err.Error())
+		}
 		rh.Status = 404
 		panic("no this template: " + templateName)
 
 	}
 	funcMaps := AddFuncMap(rh.delegate.FunctionsMap())
-	template = template.Funcs(funcMaps)
+	if len(funcMaps) == 0 {
+		return template
+	}
+	// the template is shared by the requests, the functions are set on a
+	// new clone, the pooled ones are kept for Render
+	template, err := Templates.newWithFuncs(templateName, funcMaps)
+	if err != nil {
+		rh.Status = 500
+		panic(err.Error())
+	}
 	return template
 }
 
@@ -574,6 +713,7 @@ func (rh *RequestHandler) GetTemplateNamespace() map[string]interface{} {
 	namespace := map[string]interface{}{
 		"Handler":      rh.delegate,
 		"Request":      rh.Request,
+		"CurrentUser":  rh.CurrentUser(),
 		"XsrfFormHtml": template.HTML(rh.XsrfFormHtml()),
 	}
 	return namespace
@@ -584,13 +724,19 @@ func (rh *RequestHandler) recoverFromPanic() {
 		if rh.RaiseError {
 			return
 		}
+		if err == http.ErrAbortHandler {
+			// the response cannot be completed, the server closes the connection
+			panic(err)
+		}
 
 		if rh.application.Debug {
 			//panic(err)
             debugStack := debug.Stack()
             resposeErr := fmt.Sprintf(`<html><title>Error</title><body>
-                <pre style=\"word-wrap: break-word; white-space: pre-wrap;\" >%s</pre>
-                </body></html>`, string(debugStack))
+                <pre style=\"word-wrap: break-word; white-space: pre-wrap;\" >%s
+
+%s</pre>
+                </body></html>`, template.HTMLEscapeString(fmt.Sprint(err)), string(debugStack))
             rh.HttpError(rh.Status, resposeErr)
             fmt.Println(string(debugStack))
 			return
@@ -622,15 +768,16 @@ var SUPPORTEDMETHOD = []string{"GET", "HEAD", "POST", "DELETE", "PATCH", "PUT",
 var XSRFMETHOD = []string{"GET", "HEAD", "OPTIONS"}
 
 func (rh *RequestHandler) Execute(args []string) {
+	defer rh.closeCompressor()
 	defer rh.recoverFromPanic()
-	if rh.checkNotMethod(SUPPORTEDMETHOD) {
-		rh.RaiseHttpError(405, "Method not allow")
-
+	if rh.checkNotMethod(rh.AllowedMethods()) {
+		rh.methodNotAllowed()
 	}
 	if rh.checkNotMethod(XSRFMETHOD) && rh.application.XSRFCookie {
 		rh.delegate.CheckXsrfCookie()
 	}
 	rh.delegate.Prepare()
+	rh.checkAuthenticated()
 	method := rh.Request.Method()
 	method = strings.ToUpper(method)
 	//method = strings.Title(method)
@@ -642,6 +789,7 @@ func (rh *RequestHandler) Execute(args []string) {
 
 	lemonLag.Info(logInfo)
 	rh.delegate.Finish()
+	rh.saveSession()
 
 }
 
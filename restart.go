@@ -0,0 +1,280 @@
+package lemon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Zero-downtime restart: with GracefulRestart on, SIGUSR2 starts the
+// executable again with the listening sockets as extra files and a pipe to
+// report readiness. The child serves on the inherited sockets, writes to
+// the pipe once it is about to accept, and the parent then shuts down
+// gracefully. If the child exits or is not ready in time the parent keeps
+// serving.
+//
+// The parent closes its listeners before the shutdown and waits a moment:
+// http.Server.Shutdown drops a connection accepted before it whose request
+// is read after it, so the connections just accepted get the time to send
+// their request first.
+const (
+	envInheritedFds   = "LEMON_INHERITED_FDS"   // count of listening sockets, from fd 3
+	envReadyFd        = "LEMON_READY_FD"        // write end of the readiness pipe
+	envInheritedNames = "LEMON_INHERITED_NAMES" // names of the sockets given by systemd, separated by ":"
+)
+
+// restartReadyTimeOut is how long the parent waits for the new process.
+var restartReadyTimeOut = 30 * time.Second
+
+// restartGraceTime is how long the parent keeps the accepted connections
+// before shutting down.
+var restartGraceTime = 500 * time.Millisecond
+
+// filer is implemented by the listeners whose socket can be handed down.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// inheritListeners reads the listening sockets handed down by the parent
+// process, it does nothing if the process was not started by Restart.
+func (lem *Lemon) inheritListeners() error {
+	if lem.inherited != nil || len(os.Getenv(envInheritedFds)) == 0 {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv(envInheritedFds))
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid %s: %v", envInheritedFds, err))
+	}
+	if fd, err := strconv.Atoi(os.Getenv(envReadyFd)); err == nil {
+		lem.readyPipe = os.NewFile(uintptr(fd), "ready")
+	}
+	names := strings.Split(os.Getenv(envInheritedNames), ":")
+	os.Unsetenv(envInheritedFds)
+	os.Unsetenv(envReadyFd)
+	os.Unsetenv(envInheritedNames)
+	lem.inherited = []net.Listener{}
+	for i := 0; i < count; i++ {
+		file := os.NewFile(uintptr(3+i), "listener")
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return errors.New(fmt.Sprintf("inherited socket %d: %v", 3+i, err))
+		}
+		if i < len(names) {
+			lem.setListenerName(l, names[i])
+		}
+		lem.inherited = append(lem.inherited, l)
+	}
+	return nil
+}
+
+// inheritedListener returns the inherited listener bound to address, nil
+// if there is none.
+func (lem *Lemon) inheritedListener(network, address string) (net.Listener, error) {
+	if err := lem.inheritListeners(); err != nil {
+		return nil, err
+	}
+	for i, l := range lem.inherited {
+		if sameAddr(l.Addr(), network, address) {
+			lem.inherited = append(lem.inherited[:i], lem.inherited[i+1:]...)
+			return l, nil
+		}
+	}
+	return nil, nil
+}
+
+func sameAddr(addr net.Addr, network, address string) bool {
+	if addr.Network() != network {
+		return false
+	}
+	if network == "unix" {
+		return addr.String() == address
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	want, err := net.ResolveTCPAddr(network, address)
+	if err != nil || want.Port != tcpAddr.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return tcpAddr.IP.IsUnspecified()
+	}
+	return want.IP.Equal(tcpAddr.IP)
+}
+
+// ready tells the parent process that this one is serving, the inherited
+// listeners nobody asked for are closed.
+func (lem *Lemon) ready() {
+	for _, l := range lem.inherited {
+		l.Close()
+	}
+	lem.inherited = lem.inherited[:0]
+	if lem.readyPipe != nil {
+		lem.readyPipe.Write([]byte{1})
+		lem.readyPipe.Close()
+		lem.readyPipe = nil
+	}
+}
+
+// Restart starts the executable again with the listening sockets, and
+// returns once the new process is serving and this one stopped accepting
+// connections. The caller is left to shut down this one.
+func (lem *Lemon) Restart() error {
+	return lem.restart("")
+}
+
+// restart is Restart starting executable, the running one if it is "".
+func (lem *Lemon) restart(executable string) error {
+	if lem.handingOver() {
+		return errors.New("the listeners are already handed over")
+	}
+	files, names, err := lem.listenerFiles()
+	if err != nil {
+		return err
+	}
+	defer closeFiles(files)
+	process, err := startProcess(executable, files, names, nil, nil)
+	if err != nil {
+		return err
+	}
+	lemonLag.Info(fmt.Sprintf("new process %d is serving", process.Pid))
+	lem.handOver()
+	return nil
+}
+
+// listenerFiles returns a copy of the listening sockets and their names,
+// to hand them down to a new process.
+func (lem *Lemon) listenerFiles() ([]*os.File, []string, error) {
+	files := []*os.File{}
+	names := []string{}
+	for _, l := range lem.listeners {
+		f, ok := l.(filer)
+		if !ok {
+			closeFiles(files)
+			return nil, nil, errors.New(fmt.Sprintf("cannot hand down the listener on %s", l.Addr()))
+		}
+		file, err := f.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, err
+		}
+		files = append(files, file)
+		names = append(names, lem.listenerNames[l])
+	}
+	return files, names, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// startProcess starts executable, the running one if it is "", with the
+// listening sockets files, named names, and the variables env added to its
+// environment. It returns once the new process is serving, the process is
+// killed if it is not ready in time.
+//
+// The sockets are passed by their descriptors: os/exec would put them in
+// blocking mode, which the processes already serving on them would see
+// too, their Accept would then block and Close never return.
+func startProcess(executable string, files []*os.File, names []string, env []string, attr *syscall.SysProcAttr) (*os.Process, error) {
+	var err error
+	if len(executable) == 0 {
+		if executable, err = os.Executable(); err != nil {
+			return nil, err
+		}
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyReader.Close()
+
+	fds := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}
+	for _, file := range files {
+		fds = append(fds, fileFd(file))
+	}
+	fds = append(fds, fileFd(readyWriter))
+	environ := append(os.Environ(),
+		fmt.Sprintf("%s=%d", envInheritedFds, len(files)),
+		fmt.Sprintf("%s=%d", envReadyFd, 3+len(files)),
+		fmt.Sprintf("%s=%s", envInheritedNames, strings.Join(names, ":")),
+	)
+	environ = append(environ, env...)
+	pid, _, err := syscall.StartProcess(executable, append([]string{executable}, os.Args[1:]...), &syscall.ProcAttr{
+		Env:   environ,
+		Files: fds,
+		Sys:   attr,
+	})
+	readyWriter.Close() // the read below sees EOF if the child exits
+	if err != nil {
+		return nil, &os.PathError{Op: "fork/exec", Path: executable, Err: err}
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := readyReader.Read(buf); err != nil {
+			result <- errors.New("the new process exited before it was ready")
+			return
+		}
+		result <- nil
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(restartReadyTimeOut):
+		err = errors.New("the new process was not ready in time")
+	}
+	if err != nil {
+		process.Kill()
+		process.Wait()
+		return nil, err
+	}
+	return process, nil
+}
+
+// fileFd returns the descriptor of file without changing its mode, unlike
+// File.Fd.
+func fileFd(file *os.File) uintptr {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return file.Fd()
+	}
+	var fd uintptr
+	conn.Control(func(descriptor uintptr) {
+		fd = descriptor
+	})
+	return fd
+}
+
+// handOver stops accepting the connections, which now go to the new
+// process, and lets the ones already accepted send their request.
+func (lem *Lemon) handOver() {
+	atomic.StoreInt32(&lem.handover, 1)
+	for _, l := range lem.listeners {
+		if unixListener, ok := l.(*net.UnixListener); ok {
+			// the socket file is now the new process'
+			unixListener.SetUnlinkOnClose(false)
+		}
+		l.Close()
+	}
+	time.Sleep(restartGraceTime)
+	close(lem.handedOver)
+}
+
+func (lem *Lemon) handingOver() bool {
+	return atomic.LoadInt32(&lem.handover) == 1
+}
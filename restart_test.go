@@ -0,0 +1,134 @@
+package lemon
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type pidHandler struct {
+	RequestHandler
+}
+
+func (h *pidHandler) Get(args ...string) {
+	h.Write([]byte(strconv.Itoa(os.Getpid())))
+}
+
+// serveRestartable serves pidHandler on LEMON_TEST_PORT with
+// GracefulRestart on, the processes started by Restart run it too.
+func serveRestartable() {
+	port, _ := strconv.Atoi(os.Getenv("LEMON_TEST_PORT"))
+	lem := NewLemon().Instance([]UrlSpec{AddRouter("/pid", &pidHandler{}, nil, "")},
+		map[string]interface{}{"CookieSecret": "secret", "GracefulRestart": true})
+	lem.Listen("127.0.0.1", port)
+	if err := lem.inheritListeners(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("process %d inherited %d sockets\n", os.Getpid(), len(lem.inherited))
+	if err := lem.Loop(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// getPid returns the pid of the process serving url, 0 if it cannot be
+// reached before the deadline.
+func getPid(url string, deadline time.Duration) int {
+	client := &http.Client{Timeout: time.Second}
+	for start := time.Now(); time.Since(start) < deadline; time.Sleep(50 * time.Millisecond) {
+		response, err := client.Get(url)
+		if err != nil {
+			continue
+		}
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if pid, err := strconv.Atoi(string(body)); err == nil {
+			return pid
+		}
+	}
+	return 0
+}
+
+// TestRestartHandover runs itself in a process which restarts on the
+// restart signal, the new process must serve on the socket it inherited.
+func TestRestartHandover(t *testing.T) {
+	if os.Getenv("LEMON_TEST_RESTART") == "1" {
+		serveRestartable()
+	}
+	if restartSignal == nil {
+		t.Skip("no graceful restart on this platform")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	url := fmt.Sprintf("http://127.0.0.1:%d/pid", port)
+
+	output, err := os.Create(t.TempDir() + "/output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRestartHandover$")
+	cmd.Env = append(os.Environ(), "LEMON_TEST_RESTART=1", fmt.Sprintf("LEMON_TEST_PORT=%d", port))
+	// a file, the new process keeps writing to it once the first exited
+	cmd.Stdout, cmd.Stderr = output, output
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	showOutput := func() {
+		content, _ := os.ReadFile(output.Name())
+		t.Logf("output:\n%s", content)
+	}
+
+	if pid := getPid(url, 10*time.Second); pid != cmd.Process.Pid {
+		showOutput()
+		t.Fatalf("served by %d, want the first process %d", pid, cmd.Process.Pid)
+	}
+	if err := cmd.Process.Signal(restartSignal); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			showOutput()
+			t.Fatalf("first process: %v", err)
+		}
+	case <-time.After(20 * time.Second):
+		showOutput()
+		t.Fatal("the first process did not exit after the restart")
+	}
+
+	child := getPid(url, 5*time.Second)
+	if child == 0 || child == cmd.Process.Pid {
+		showOutput()
+		t.Fatalf("served by %d after the restart", child)
+	}
+	process, err := os.FindProcess(child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	process.Signal(os.Interrupt)
+	if pid := getPid(url, 2*time.Second); pid != 0 {
+		// still serving after a while, kill it
+		process.Kill()
+	}
+	content, _ := os.ReadFile(output.Name())
+	if want := fmt.Sprintf("process %d inherited 1 sockets", child); !strings.Contains(string(content), want) {
+		t.Errorf("%q not in the output:\n%s", want, content)
+	}
+}
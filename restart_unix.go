@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package lemon
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignal makes a server with GracefulRestart on restart itself.
+var restartSignal os.Signal = syscall.SIGUSR2
@@ -0,0 +1,7 @@
+package lemon
+
+import "os"
+
+// restartSignal is nil, there is no SIGUSR2 on windows so GracefulRestart
+// is ignored.
+var restartSignal os.Signal
@@ -0,0 +1,156 @@
+package lemon
+
+// router dispatches a request path to the first matching UrlSpec of a host.
+//
+// Every UrlSpec is indexed in a radix tree by the literal prefix of its
+// regex (for example "/users/" for "/users/([0-9]+)"), so a lookup only
+// walks the characters of the path and tries the regexes of the routes
+// hanging on that walk, instead of every route of the host. Patterns with
+// no literal prefix (".*", alternations, ...) live on the root node and act
+// as the regex fallbacks. Among the candidates the route added first wins,
+// exactly like a linear scan of the UrlSpec slice would.
+type router struct {
+	root  *routeNode
+	specs []UrlSpec
+}
+
+type routeNode struct {
+	prefix   string
+	children []*routeNode
+	routes   []routeEntry // sorted by index
+}
+
+// routeMatch is the UrlSpec found for a path and what it captured.
+type routeMatch struct {
+	spec          *UrlSpec
+	args          []string
+	pathArguments map[string]string
+	pathValues    map[string]interface{}
+}
+
+type routeEntry struct {
+	index    int
+	literal  string
+	complete bool // the pattern is the plain literal, no regex needed
+}
+
+func newRouter(specs []UrlSpec) *router {
+	rt := &router{root: &routeNode{}}
+	for _, spec := range specs {
+		rt.add(spec)
+	}
+	return rt
+}
+
+// add appends spec after the routes already added.
+func (rt *router) add(spec UrlSpec) {
+	index := len(rt.specs)
+	rt.specs = append(rt.specs, spec)
+	if spec.Regexps == nil {
+		return
+	}
+	prefix, complete := spec.Regexps.LiteralPrefix()
+	rt.root.insert(prefix, routeEntry{index: index, literal: prefix, complete: complete})
+}
+
+func (node *routeNode) insert(key string, entry routeEntry) {
+	for {
+		if len(key) == 0 {
+			node.routes = append(node.routes, entry)
+			return
+		}
+		child := node.child(key[0])
+		if child == nil {
+			node.children = append(node.children, &routeNode{prefix: key, routes: []routeEntry{entry}})
+			return
+		}
+		common := commonPrefix(key, child.prefix)
+		if common < len(child.prefix) {
+			// split the edge: child keeps the tail, a new node takes the head
+			split := &routeNode{
+				prefix:   child.prefix[:common],
+				children: []*routeNode{child},
+			}
+			node.replaceChild(split)
+			child.prefix = child.prefix[common:]
+			child = split
+		}
+		node = child
+		key = key[common:]
+	}
+}
+
+func (node *routeNode) child(label byte) *routeNode {
+	for _, child := range node.children {
+		if child.prefix[0] == label {
+			return child
+		}
+	}
+	return nil
+}
+
+func (node *routeNode) replaceChild(child *routeNode) {
+	for i, old := range node.children {
+		if old.prefix[0] == child.prefix[0] {
+			node.children[i] = child
+			return
+		}
+	}
+}
+
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// lookup returns the first UrlSpec matching path and its captured groups.
+func (rt *router) lookup(path string) (*routeMatch, bool) {
+	candidates := make([][]routeEntry, 0, 8)
+	node := rt.root
+	search := path
+	for {
+		if len(node.routes) > 0 {
+			candidates = append(candidates, node.routes)
+		}
+		if len(search) == 0 {
+			break
+		}
+		child := node.child(search[0])
+		if child == nil || len(search) < len(child.prefix) || search[:len(child.prefix)] != child.prefix {
+			break
+		}
+		search = search[len(child.prefix):]
+		node = child
+	}
+
+	// merge the candidate lists by registration order, first match wins
+	for {
+		best := -1
+		for i, entries := range candidates {
+			if len(entries) == 0 {
+				continue
+			}
+			if best < 0 || entries[0].index < candidates[best][0].index {
+				best = i
+			}
+		}
+		if best < 0 {
+			return nil, false
+		}
+		entry := candidates[best][0]
+		candidates[best] = candidates[best][1:]
+		spec := &rt.specs[entry.index]
+		if entry.complete {
+			if entry.literal == path {
+				return &routeMatch{spec: spec, args: []string{}}, true
+			}
+			continue
+		}
+		if match, ok := spec.match(path); ok {
+			return match, true
+		}
+	}
+}
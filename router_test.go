@@ -0,0 +1,100 @@
+package lemon
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRouterLookup(t *testing.T) {
+	rt := newRouter([]UrlSpec{
+		AddRouter("/users/([0-9]+)", &getOnlyHandler{}, nil, "user"),
+		AddRouter("/users/new", &getOnlyHandler{}, nil, "new"),
+		AddRouter("/users/(.*)", &getOnlyHandler{}, nil, "users"),
+		AddRouter("/(a|b)/x", &getOnlyHandler{}, nil, "alternation"),
+		AddRouter("/docs/", &getOnlyHandler{}, nil, "docs/"),
+		AddRouter("/docs", &getOnlyHandler{}, nil, "docs"),
+		AddRouter("^/anchored$", &getOnlyHandler{}, nil, "anchored"),
+		AddRouter(".*\\.txt", &getOnlyHandler{}, nil, "txt"),
+	})
+	tests := []struct {
+		path string
+		name string
+		args []string
+	}{
+		{"/users/42", "user", []string{"42"}},
+		{"/users/new", "new", []string{}},
+		{"/users/bob", "users", []string{"bob"}},
+		// added before the fallback on the root, though deeper in the tree
+		{"/users/notes.txt", "users", []string{"notes.txt"}},
+		{"/a/x", "alternation", []string{"a"}},
+		{"/c/x", "", nil},
+		{"/docs/", "docs/", []string{}},
+		{"/docs", "docs", []string{}},
+		{"/docs/intro", "", nil},
+		{"/anchored", "anchored", []string{}},
+		{"/anchored/", "", nil},
+		{"/x/anchored", "", nil},
+		// no literal prefix, only the regexp fallback matches
+		{"/robots.txt", "txt", []string{}},
+		{"/", "", nil},
+	}
+	for _, test := range tests {
+		match, ok := rt.lookup(test.path)
+		if len(test.name) == 0 {
+			if ok {
+				t.Errorf("%s: matched %s", test.path, match.spec.Name)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: no match, want %s", test.path, test.name)
+			continue
+		}
+		if match.spec.Name != test.name || !reflect.DeepEqual(match.args, test.args) {
+			t.Errorf("%s: %s %q, want %s %q", test.path, match.spec.Name, match.args, test.name, test.args)
+		}
+	}
+}
+
+// TestRouterFirstMatchWins checks the route added first wins across the
+// prefix buckets of the tree, whichever is the longer prefix.
+func TestRouterFirstMatchWins(t *testing.T) {
+	tests := []struct {
+		specs []UrlSpec
+		path  string
+		name  string
+	}{
+		{[]UrlSpec{
+			AddRouter("/(.*)", &getOnlyHandler{}, nil, "root"),
+			AddRouter("/users/([0-9]+)", &getOnlyHandler{}, nil, "user"),
+		}, "/users/1", "root"},
+		{[]UrlSpec{
+			AddRouter("/users/([0-9]+)", &getOnlyHandler{}, nil, "user"),
+			AddRouter("/(.*)", &getOnlyHandler{}, nil, "root"),
+		}, "/users/1", "user"},
+		{[]UrlSpec{
+			AddRouter(".*", &getOnlyHandler{}, nil, "fallback"),
+			AddRouter("/users/1", &getOnlyHandler{}, nil, "literal"),
+		}, "/users/1", "fallback"},
+		{[]UrlSpec{
+			AddRouter("/users/1", &getOnlyHandler{}, nil, "literal"),
+			AddRouter("/users/([0-9]+)", &getOnlyHandler{}, nil, "user"),
+			AddRouter(".*", &getOnlyHandler{}, nil, "fallback"),
+		}, "/users/1", "literal"},
+		{[]UrlSpec{
+			AddRouter("/user", &getOnlyHandler{}, nil, "short"),
+			AddRouter("/users", &getOnlyHandler{}, nil, "long"),
+			AddRouter("/u(.*)", &getOnlyHandler{}, nil, "prefix"),
+		}, "/users", "long"},
+	}
+	for _, test := range tests {
+		match, ok := newRouter(test.specs).lookup(test.path)
+		if !ok || match.spec.Name != test.name {
+			var name string
+			if ok {
+				name = match.spec.Name
+			}
+			t.Errorf("%s with %s first: matched %q, want %s", test.path, test.specs[0].Name, name, test.name)
+		}
+	}
+}
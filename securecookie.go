@@ -0,0 +1,113 @@
+package lemon
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signedValueVersion is the version of the signed value format:
+//
+//	2|<keyid>|<timestamp>|<name>|<value>|<signature>
+//
+// every field but the signature is written as "length:content", value is
+// base64 encoded and signature is the hex HMAC-SHA256 of everything before
+// it, so a value signed for a cookie can't be replayed in another one.
+const signedValueVersion = "2"
+
+// defaultKeyVersion is the key id of a CookieSecret given as a string.
+const defaultKeyVersion = "0"
+
+// createSignedValue signs and timestamps value for the cookie name with
+// the secret keyVersion.
+func createSignedValue(secret, keyVersion, name, value string, now time.Time) string {
+	var b bytes.Buffer
+	b.WriteString(signedValueVersion + "|")
+	for _, field := range []string{
+		keyVersion,
+		strconv.FormatInt(now.Unix(), 10),
+		name,
+		base64.URLEncoding.EncodeToString([]byte(value)),
+	} {
+		fmt.Fprintf(&b, "%d:%s|", len(field), field)
+	}
+	b.WriteString(signValue(secret, b.String()))
+	return b.String()
+}
+
+// decodeSignedValue returns the value signed by createSignedValue if the
+// signature matches one of secrets, it was signed for the cookie name and
+// is not older than maxAge seconds.
+func decodeSignedValue(secrets map[string]string, name, signed string, maxAge int, now time.Time) (string, error) {
+	if !strings.HasPrefix(signed, signedValueVersion+"|") {
+		return "", errors.New("unsupported signed value version")
+	}
+	rest := signed[len(signedValueVersion)+1:]
+	fields := make([]string, 4)
+	for i := range fields {
+		var err error
+		if fields[i], rest, err = consumeField(rest); err != nil {
+			return "", err
+		}
+	}
+	keyVersion, timestamp, signedName, encoded := fields[0], fields[1], fields[2], fields[3]
+	secret, ok := secrets[keyVersion]
+	if !ok {
+		return "", errors.New(fmt.Sprintf("unknown key version %s", keyVersion))
+	}
+	expected := signValue(secret, signed[:len(signed)-len(rest)])
+	if !hmac.Equal([]byte(rest), []byte(expected)) {
+		return "", errors.New("invalid signature")
+	}
+	if signedName != name {
+		return "", errors.New("signed for another cookie")
+	}
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", err
+	}
+	age := now.Unix() - signedAt
+	if maxAge > 0 && age > int64(maxAge) {
+		return "", errors.New("expired signed value")
+	}
+	if maxAge > 0 && age < -int64(maxAge) {
+		// a timestamp far in the future is not one we created
+		return "", errors.New("signed value from the future")
+	}
+	value, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// consumeField reads a "length:content|" field at the start of s.
+func consumeField(s string) (string, string, error) {
+	colon := strings.Index(s, ":")
+	if colon < 0 {
+		return "", "", errors.New("malformed signed value")
+	}
+	length, err := strconv.Atoi(s[:colon])
+	// checked before adding, a huge length would overflow
+	if err != nil || length < 0 || length >= len(s)-colon-1 {
+		return "", "", errors.New("malformed signed value")
+	}
+	end := colon + 1 + length
+	if s[end] != '|' {
+		return "", "", errors.New("malformed signed value")
+	}
+	return s[colon+1 : end], s[end+1:], nil
+}
+
+func signValue(secret, value string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(value))
+	return hex.EncodeToString(h.Sum(nil))
+}
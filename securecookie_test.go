@@ -0,0 +1,48 @@
+package lemon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConsumeField(t *testing.T) {
+	content, rest, err := consumeField("5:hello|rest")
+	if err != nil || content != "hello" || rest != "rest" {
+		t.Errorf("consumeField = %q, %q, %v", content, rest, err)
+	}
+	for _, s := range []string{
+		"",
+		"hello|",
+		"x:hello|",
+		"-1:hello|",
+		"5:hell|",
+		"5:hello",
+		"5:helloX",
+		"4:hello|",
+		"9223372036854775807:x|rest",
+		"9223372036854775806:x|rest",
+		"99999999999999999999:x|rest",
+	} {
+		if _, _, err := consumeField(s); err == nil {
+			t.Errorf("consumeField(%q) accepted a malformed field", s)
+		}
+	}
+}
+
+func TestDecodeSignedValue(t *testing.T) {
+	secrets := map[string]string{defaultKeyVersion: "secret"}
+	now := time.Unix(1600000000, 0)
+	signed := createSignedValue("secret", defaultKeyVersion, "user", "bob", now)
+	if value, err := decodeSignedValue(secrets, "user", signed, 3600, now); err != nil || value != "bob" {
+		t.Errorf("decodeSignedValue = %q, %v", value, err)
+	}
+	for _, signed := range []string{
+		signed[:len(signed)-1],
+		"2|1:0|9223372036854775807:1|4:user|4:Ym9i|sig",
+		"2|1:0|10:1600000000|9223372036854775797:user|",
+	} {
+		if _, err := decodeSignedValue(secrets, "user", signed, 3600, now); err == nil {
+			t.Errorf("decodeSignedValue(%q) accepted a forged value", signed)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package lemon
+
+import (
+	"fmt"
+	"github.com/ouyangshangwen/lemon/utils"
+	"time"
+)
+
+// SessionStore keeps the values of the sessions between requests.
+//
+// The id returned by Set is the one sent to the browser in the signed
+// session cookie and given back to Get, a server side store returns the
+// id it was given while a cookie store returns the encoded values.
+type SessionStore interface {
+	Get(id string) (map[string]interface{}, error) // nil values if the session does not exist or expired
+	Set(id string, values map[string]interface{}, maxAge time.Duration) (string, error)
+	Delete(id string) error
+}
+
+// Session is the server side session of a request, see
+// RequestHandler.Session. It is saved when the response headers are
+// written or the handler finishes, only if it was modified.
+type Session struct {
+	id        string
+	oldId     string // id before Regenerate, deleted from the store on save
+	values    map[string]interface{}
+	isNew     bool
+	modified  bool
+	destroyed bool
+}
+
+func newSession() *Session {
+	return &Session{id: newSessionId(), values: map[string]interface{}{}, isNew: true}
+}
+
+func newSessionId() string {
+	return string(utils.RandomCreateBytes(32))
+}
+
+// Id returns the id of the session.
+func (s *Session) Id() string {
+	return s.id
+}
+
+// IsNew reports whether the session was created by this request.
+func (s *Session) IsNew() bool {
+	return s.isNew
+}
+
+// Get returns the value of key, nil if it is not set.
+func (s *Session) Get(key string) interface{} {
+	return s.values[key]
+}
+
+// Set sets the value of key.
+func (s *Session) Set(key string, value interface{}) {
+	s.values[key] = value
+	s.modified = true
+}
+
+// Delete removes key from the session.
+func (s *Session) Delete(key string) {
+	if _, ok := s.values[key]; ok {
+		delete(s.values, key)
+		s.modified = true
+	}
+}
+
+// Keys returns the keys set in the session.
+func (s *Session) Keys() []string {
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Clear removes every value of the session.
+func (s *Session) Clear() {
+	s.values = map[string]interface{}{}
+	s.modified = true
+}
+
+// Regenerate gives the session a new id and keeps its values, so an id
+// known before a login can't be used after it. RequestHandler.SetCurrentUser
+// calls it when the user changes.
+func (s *Session) Regenerate() {
+	if !s.isNew && s.oldId == "" {
+		s.oldId = s.id
+	}
+	s.id = newSessionId()
+	s.modified = true
+}
+
+// Destroy deletes the session from the store and clears its cookie.
+func (s *Session) Destroy() {
+	s.values = map[string]interface{}{}
+	s.destroyed = true
+	s.modified = true
+}
+
+// hasSession reports whether the request has a session, loaded or sent in
+// the session cookie.
+func (rh *RequestHandler) hasSession() bool {
+	return rh.session != nil || len(rh.GetCookie(rh.application.SessionCookie)) != 0
+}
+
+// loadSession returns the session whose id is in the session cookie of
+// the request, or a new one.
+func (rh *RequestHandler) loadSession() *Session {
+	store := rh.application.SessionStore
+	id := rh.GetSecureCookieMaxAge(rh.application.SessionCookie, rh.application.SessionMaxAge)
+	if len(id) == 0 {
+		return newSession()
+	}
+	values, err := store.Get(id)
+	if err != nil {
+		lemonLag.Warning(fmt.Sprintf("Error loading session:%v", err))
+	}
+	if values == nil {
+		// never reuse an id sent by the browser for a new session
+		return newSession()
+	}
+	return &Session{id: id, values: values}
+}
+
+// saveSession saves the session if it was modified, the session cookie is
+// only updated while the headers are not written.
+func (rh *RequestHandler) saveSession() {
+	session := rh.session
+	if session == nil || !session.modified {
+		return
+	}
+	store := rh.application.SessionStore
+	cookieName := rh.application.SessionCookie
+	session.modified = false
+	regenerated := session.oldId != ""
+	if regenerated {
+		if err := store.Delete(session.oldId); err != nil {
+			lemonLag.Warning(fmt.Sprintf("Error deleting session:%v", err))
+		}
+		session.oldId = ""
+	}
+	if session.destroyed {
+		if !session.isNew {
+			if err := store.Delete(session.id); err != nil {
+				lemonLag.Warning(fmt.Sprintf("Error deleting session:%v", err))
+			}
+		}
+		if !rh.WroteHeader {
+			rh.ClearCookie(cookieName)
+		}
+		return
+	}
+	maxAge := time.Duration(rh.application.SessionMaxAge) * time.Second
+	id, err := store.Set(session.id, session.values, maxAge)
+	if err != nil {
+		lemonLag.Error(fmt.Sprintf("Error saving session:%v", err))
+		return
+	}
+	isNew := session.isNew
+	session.isNew = false
+	if rh.WroteHeader {
+		if isNew || regenerated || id != session.id {
+			lemonLag.Warning("session modified after the headers were written, the change is lost")
+		}
+		return
+	}
+	session.id = id
+	others := map[string]interface{}{"HttpOnly": true}
+	if maxAge > 0 {
+		others["expires"] = time.Now().Add(maxAge)
+	}
+	rh.SetSecureCookie(cookieName, id, others)
+}
@@ -0,0 +1,87 @@
+package lemon
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type loginHandler struct {
+	RequestHandler
+}
+
+func (h *loginHandler) GetCurrentUser() interface{} {
+	return h.Session().Get("user")
+}
+
+// Prepare loads the user like an authenticated handler.
+func (h *loginHandler) Prepare() {
+	h.CurrentUser()
+}
+
+func (h *loginHandler) Get(args ...string) {
+	h.Session().Set("visited", true)
+}
+
+func (h *loginHandler) Post(args ...string) {
+	user := h.GetArgument("user")
+	if len(user) == 0 {
+		h.Session().Delete("user")
+		h.SetCurrentUser(nil)
+		return
+	}
+	h.Session().Set("user", user)
+	h.SetCurrentUser(user)
+}
+
+func TestSetCurrentUserRegeneratesSession(t *testing.T) {
+	app := NewApplication()
+	app.Init([]UrlSpec{AddRouter("/", &loginHandler{}, nil, "")},
+		map[string]interface{}{"CookieSecret": "secret"})
+	var cookie *http.Cookie
+	serve := func(method, query string) string {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/"+query, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		app.ServeHTTP(rw, r)
+		for _, c := range rw.Result().Cookies() {
+			if c.Name == app.SessionCookie {
+				cookie = c
+			}
+		}
+		if rw.Code != 200 {
+			t.Fatalf("%s %s: status %d", method, query, rw.Code)
+		}
+		return cookie.Value
+	}
+	id := func(value string) string {
+		id, err := decodeSignedValue(map[string]string{defaultKeyVersion: "secret"}, app.SessionCookie, value, 0, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	anonymous := id(serve("GET", ""))
+	bob := id(serve("POST", "?user=bob"))
+	if bob == anonymous {
+		t.Fatal("session id kept on login")
+	}
+	if values, _ := app.SessionStore.Get(anonymous); values != nil {
+		t.Errorf("session before the login still in the store: %v", values)
+	}
+	if values, _ := app.SessionStore.Get(bob); values["user"] != "bob" || values["visited"] != true {
+		t.Errorf("session values after the login: %v", values)
+	}
+	if again := id(serve("POST", "?user=bob")); again != bob {
+		t.Error("session regenerated for the same user")
+	}
+	if alice := id(serve("POST", "?user=alice")); alice == bob {
+		t.Error("session id kept on a change of user")
+	}
+	if loggedOut := id(serve("POST", "?user=")); loggedOut == bob {
+		t.Error("session id kept on logout")
+	}
+}
@@ -0,0 +1,297 @@
+package lemon
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// sessionData is what the file and cookie stores encode with gob, custom
+// types stored in a session must be registered with gob.Register.
+type sessionData struct {
+	Expires time.Time
+	Values  map[string]interface{}
+}
+
+func (data *sessionData) expired() bool {
+	return !data.Expires.IsZero() && time.Now().After(data.Expires)
+}
+
+func newSessionData(values map[string]interface{}, maxAge time.Duration) *sessionData {
+	data := &sessionData{Values: values}
+	if maxAge > 0 {
+		data.Expires = time.Now().Add(maxAge)
+	}
+	return data
+}
+
+func copyValues(values map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		copied[key] = value
+	}
+	return copied
+}
+
+// MemorySessionStore keeps the sessions in the memory of the process, the
+// expired ones are removed every sweep interval.
+type MemorySessionStore struct {
+	lock          sync.RWMutex
+	sessions      map[string]*sessionData
+	sweepInterval time.Duration
+	sweepOnce     sync.Once
+}
+
+// NewMemorySessionStore returns a MemorySessionStore sweeping the expired
+// sessions every sweepInterval, default one minute.
+func NewMemorySessionStore(sweepInterval time.Duration) *MemorySessionStore {
+	if sweepInterval <= 0 {
+		sweepInterval = time.Minute
+	}
+	return &MemorySessionStore{sessions: map[string]*sessionData{}, sweepInterval: sweepInterval}
+}
+
+func (ms *MemorySessionStore) Get(id string) (map[string]interface{}, error) {
+	ms.lock.RLock()
+	data, ok := ms.sessions[id]
+	ms.lock.RUnlock()
+	if !ok || data.expired() {
+		return nil, nil
+	}
+	return copyValues(data.Values), nil
+}
+
+func (ms *MemorySessionStore) Set(id string, values map[string]interface{}, maxAge time.Duration) (string, error) {
+	ms.sweepOnce.Do(func() {
+		go ms.sweep()
+	})
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.sessions[id] = newSessionData(copyValues(values), maxAge)
+	return id, nil
+}
+
+func (ms *MemorySessionStore) Delete(id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.sessions, id)
+	return nil
+}
+
+// Len returns the count of sessions in the store, expired ones included
+// until they are swept.
+func (ms *MemorySessionStore) Len() int {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return len(ms.sessions)
+}
+
+func (ms *MemorySessionStore) sweep() {
+	for range time.Tick(ms.sweepInterval) {
+		ms.Sweep()
+	}
+}
+
+// Sweep removes the expired sessions.
+func (ms *MemorySessionStore) Sweep() {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for id, data := range ms.sessions {
+		if data.expired() {
+			delete(ms.sessions, id)
+		}
+	}
+}
+
+// FileSessionStore keeps every session in a file of a directory.
+type FileSessionStore struct {
+	path string
+}
+
+// NewFileSessionStore returns a FileSessionStore writing in the directory
+// path, created if it does not exist.
+func NewFileSessionStore(path string) (*FileSessionStore, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	return &FileSessionStore{path: path}, nil
+}
+
+func (fs *FileSessionStore) filename(id string) (string, error) {
+	if len(id) == 0 {
+		return "", errors.New("empty session id")
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return "", errors.New("invalid session id")
+		}
+	}
+	return filepath.Join(fs.path, "lemon_session_"+id), nil
+}
+
+func (fs *FileSessionStore) Get(id string) (map[string]interface{}, error) {
+	filename, err := fs.filename(id)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data := &sessionData{}
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(data); err != nil {
+		return nil, err
+	}
+	if data.expired() {
+		os.Remove(filename)
+		return nil, nil
+	}
+	if data.Values == nil {
+		data.Values = map[string]interface{}{}
+	}
+	return data.Values, nil
+}
+
+func (fs *FileSessionStore) Set(id string, values map[string]interface{}, maxAge time.Duration) (string, error) {
+	filename, err := fs.filename(id)
+	if err != nil {
+		return "", err
+	}
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(newSessionData(values, maxAge)); err != nil {
+		return "", err
+	}
+	// write then rename so a concurrent Get never reads half a session
+	tmp, err := ioutil.TempFile(fs.path, "lemon_tmp_")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(content.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return id, nil
+}
+
+func (fs *FileSessionStore) Delete(id string) error {
+	filename, err := fs.filename(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Sweep removes the files of the expired sessions.
+func (fs *FileSessionStore) Sweep() error {
+	files, err := filepath.Glob(filepath.Join(fs.path, "lemon_session_*"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		fs.Get(filepath.Base(file)[len("lemon_session_"):])
+	}
+	return nil
+}
+
+// CookieSessionStore keeps the sessions in the session cookie itself, it
+// is signed like every secure cookie and, with a key, encrypted with
+// AES-GCM. Browsers limit cookies to about 4KB.
+type CookieSessionStore struct {
+	aead cipher.AEAD
+}
+
+// NewCookieSessionStore returns a CookieSessionStore encrypting the
+// sessions with key, or only signing them if key is empty.
+func NewCookieSessionStore(key string) (*CookieSessionStore, error) {
+	store := &CookieSessionStore{}
+	if len(key) == 0 {
+		return store, nil
+	}
+	hashed := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(hashed[:])
+	if err != nil {
+		return nil, err
+	}
+	if store.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (cs *CookieSessionStore) Get(id string) (map[string]interface{}, error) {
+	content, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return nil, err
+	}
+	if cs.aead != nil {
+		nonceSize := cs.aead.NonceSize()
+		if len(content) < nonceSize {
+			return nil, errors.New("invalid session cookie")
+		}
+		if content, err = cs.aead.Open(nil, content[:nonceSize], content[nonceSize:], nil); err != nil {
+			return nil, err
+		}
+	}
+	data := &sessionData{}
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(data); err != nil {
+		return nil, err
+	}
+	if data.expired() {
+		return nil, nil
+	}
+	if data.Values == nil {
+		data.Values = map[string]interface{}{}
+	}
+	return data.Values, nil
+}
+
+func (cs *CookieSessionStore) Set(id string, values map[string]interface{}, maxAge time.Duration) (string, error) {
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(newSessionData(values, maxAge)); err != nil {
+		return "", err
+	}
+	encoded := content.Bytes()
+	if cs.aead != nil {
+		nonce := make([]byte, cs.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return "", err
+		}
+		encoded = cs.aead.Seal(nonce, nonce, encoded, nil)
+	}
+	cookie := base64.RawURLEncoding.EncodeToString(encoded)
+	if len(cookie) > 4000 {
+		return "", errors.New("session too large for a cookie")
+	}
+	return cookie, nil
+}
+
+// Delete does nothing, the session goes away with its cookie.
+func (cs *CookieSessionStore) Delete(id string) error {
+	return nil
+}
@@ -1,13 +1,19 @@
 package lemon
 
 import (
+	"bytes"
 	"github.com/ouyangshangwen/lemon/utils"
+	"io"
+	"io/fs"
+	"io/ioutil"
 	"mime"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,12 +22,18 @@ type StaticFileHandler struct {
 	ModifiedTime time.Time
 	CACHEMAXAGE  int
 	root         string
+	fsys         fs.FS // the files served, the directory root unless given by the "fs" param
 	Extension    string
 }
 
 func (sh *StaticFileHandler) Initialize(params Dictionary) {
 	sh.CACHEMAXAGE = 86400 * 365 * 10
-	sh.root = params["path"].(string)
+	sh.root, _ = params["path"].(string)
+	if fsys, ok := params["fs"].(fs.FS); ok {
+		sh.fsys = fsys
+	} else {
+		sh.fsys = os.DirFS(sh.root)
+	}
 }
 
 func (sh *StaticFileHandler) Get(Path ...string) {
@@ -32,19 +44,28 @@ func (sh *StaticFileHandler) Get(Path ...string) {
 	}
 	//requestPath := path.Clean(sh.Request.Url())
 	//file := path.Join(sh.application.AbsWorkPath, sh.application.StaticPath, Path)
-	file := path.Join(sh.root, Path[0])
-	fileStat, err := os.Stat(file)
+	file := strings.TrimPrefix(path.Clean("/"+Path[0]), "/")
+	if len(file) == 0 {
+		file = "."
+	}
+	fsFile, err := sh.fsys.Open(file)
 	if err != nil {
 		http.NotFound(sh.ResponseWriter, sh.Request.Request)
 		return
 	}
+	defer fsFile.Close()
+	fileStat, err := fsFile.Stat()
+	if err != nil || fileStat.IsDir() {
+		http.NotFound(sh.ResponseWriter, sh.Request.Request)
+		return
+	}
 
-	sh.ModifiedTime = fileStat.ModTime()
+	sh.ModifiedTime = staticModTime(fileStat)
 	sh.SetHeaders()
 	var contentEncoding string
 	if sh.application.IsGzip {
 		contentEncoding = getAcceptEncodingZip(sh.Request.Request)
-		memzipfile, err := openMemZipFile(file, contentEncoding)
+		memzipfile, err := openMemZipFile(sh.fsys, file, contentEncoding)
 		if err != nil {
 			http.NotFound(sh.ResponseWriter, sh.Request.Request)
 			return
@@ -58,14 +79,46 @@ func (sh *StaticFileHandler) Get(Path ...string) {
 			sh.SetHeader("Content-Length", strconv.FormatInt(fileStat.Size(), 10))
 		}
 
-		http.ServeContent(sh.ResponseWriter, sh.Request.Request, file, fileStat.ModTime(), memzipfile)
+		http.ServeContent(sh.ResponseWriter, sh.Request.Request, file, sh.ModifiedTime, memzipfile)
 
 	} else {
-		http.ServeFile(sh.ResponseWriter, sh.Request.Request, file)
+		content, ok := fsFile.(io.ReadSeeker)
+		if !ok {
+			// e.g. the files of a zip archive
+			data, err := ioutil.ReadAll(fsFile)
+			if err != nil {
+				http.NotFound(sh.ResponseWriter, sh.Request.Request)
+				return
+			}
+			content = bytes.NewReader(data)
+		}
+		http.ServeContent(sh.ResponseWriter, sh.Request.Request, file, sh.ModifiedTime, content)
 	}
 
 }
 
+var executableModTime struct {
+	once    sync.Once
+	modTime time.Time
+}
+
+// staticModTime returns the modification time of the file, the one of the
+// executable if it has none, like the files of an embed.FS which only
+// change with the executable.
+func staticModTime(fileStat fs.FileInfo) time.Time {
+	if modTime := fileStat.ModTime(); !modTime.IsZero() {
+		return modTime
+	}
+	executableModTime.once.Do(func() {
+		if executable, err := os.Executable(); err == nil {
+			if executableStat, err := os.Stat(executable); err == nil {
+				executableModTime.modTime = executableStat.ModTime()
+			}
+		}
+	})
+	return executableModTime.modTime
+}
+
 func (sh *StaticFileHandler) SetHeaders() {
 	sh.SetHeader("Accept-Ranges", "bytes")
 
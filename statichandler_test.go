@@ -0,0 +1,35 @@
+package lemon
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+// TestStaticFSGzipCache checks the compressed copies of two StaticFS with
+// the same file name and size, which have no modification time, are kept
+// apart.
+func TestStaticFSGzipCache(t *testing.T) {
+	for _, content := range []string{"first app", "other app"} {
+		app := NewApplication()
+		app.Init(nil, map[string]interface{}{"CookieSecret": "secret", "IsGzip": true,
+			"StaticFS": fstest.MapFS{"app.js": {Data: []byte(content)}}})
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/static/app.js", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		app.ServeHTTP(rw, r)
+		if encoding := rw.Header().Get("Content-Encoding"); encoding != "gzip" {
+			t.Fatalf("%s: Content-Encoding %q", content, encoding)
+		}
+		reader, err := gzip.NewReader(rw.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(reader)
+		if err != nil || string(body) != content {
+			t.Errorf("%s: %q %v", content, body, err)
+		}
+	}
+}
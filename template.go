@@ -4,11 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
-	"io/ioutil"
+	"io"
+	"io/fs"
 	"os"
-	"path/filepath"
+	"path"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"text/template/parse"
 )
 
 type Template struct {
@@ -18,11 +22,17 @@ type Template struct {
 	LeftBraces   string
 	RightBraces  string
 	templatefile *TemplateFile
+	lock         sync.RWMutex      // held to replace Templates while they are built again
+	fsys         fs.FS             // the files given to BuildTemplateFS
+	match        func(string) bool // accepts the files built, see Load
+	errors       map[string]error
+	pools        map[string]*sync.Pool // clones of Templates executed with the functions of a request, see withFuncs
 }
 
 type TemplateFile struct {
-	root  string
+	fsys  fs.FS
 	files map[string][]string
+	match func(string) bool // accepts the files parsed, all of them if nil
 }
 
 //var template *Template
@@ -39,6 +49,7 @@ func TemplateInit(leftBraces, rightBraces string) *Template {
 	FuncMap["str2html"] = Str2html
 	FuncMap["htmlquote"] = Htmlquote
 	FuncMap["htmlunquote"] = Htmlunquote
+	FuncMap["extends"] = Extends
 	return &Template{FuncMap: FuncMap, Templates: Templates, LeftBraces: leftBraces, RightBraces: rightBraces}
 
 }
@@ -49,22 +60,21 @@ func (tpl *Template) AddFuncMap(key string, funname interface{}) error {
 	return nil
 }
 
-func (tpl *TemplateFile) visit(paths string, f os.FileInfo, err error) error {
-	if f == nil {
+func (tpl *TemplateFile) visit(file string, d fs.DirEntry, err error) error {
+	if d == nil {
 		return err
 	}
 
-	if f.IsDir() || (f.Mode()&os.ModeSymlink) > 0 {
+	if d.IsDir() || (d.Type()&fs.ModeSymlink) > 0 {
 		return nil
 	}
 	//	if !HasTemplateExt(paths) {
 	//		return nil
 	//	}
-	replace := strings.NewReplacer("\\", "/")
-	a := []byte(paths)
-	a = a[len([]byte(tpl.root)):]
-	file := strings.TrimLeft(replace.Replace(string(a)), "/")
-	subdir := filepath.Dir(file)
+	if tpl.match != nil && !tpl.match(file) {
+		return nil
+	}
+	subdir := path.Dir(file)
 	if _, ok := tpl.files[subdir]; ok {
 		tpl.files[subdir] = append(tpl.files[subdir], file)
 	} else {
@@ -76,52 +86,279 @@ func (tpl *TemplateFile) visit(paths string, f os.FileInfo, err error) error {
 	return nil
 }
 
+// BuildTemplate parses every file under templatePath, see BuildTemplateFS.
 func (tpl *Template) BuildTemplate(templatePath string) error {
 	//	workPath, _ := os.Getwd()
 	//	AbsWorkPath, _ := filepath.Abs(workPath)
 	//	templatePath := filepath.Join(AbsWorkPath, dir)
-	if _, err := os.Stat(templatePath); err != nil {
-		if os.IsNotExist(err) {
+	return tpl.BuildTemplateFS(os.DirFS(templatePath))
+}
+
+// BuildTemplateFS parses every file of fsys, e.g. an embed.FS. It returns an
+// error listing the files which cannot be parsed, with the line of the
+// error, or which call a template that does not exist. The other files are
+// parsed.
+func (tpl *Template) BuildTemplateFS(fsys fs.FS) error {
+	tpl.lock.Lock()
+	tpl.fsys = fsys
+	match := tpl.match
+	tpl.lock.Unlock()
+	if _, err := fs.Stat(fsys, "."); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
 			return nil
 		} else {
 			return errors.New("dir open err")
 		}
 	}
-	tpl.templatefile = &TemplateFile{
-		root:  templatePath,
+	templatefile := &TemplateFile{
+		fsys:  fsys,
 		files: make(map[string][]string),
+		match: match,
 	}
-	err := filepath.Walk(templatePath, func(path string, f os.FileInfo, err error) error {
-		return tpl.templatefile.visit(path, f, err)
-	})
+	err := fs.WalkDir(fsys, ".", templatefile.visit)
 	if err != nil {
-		fmt.Printf("filepath.Walk() returned %v\n", err)
+		fmt.Printf("fs.WalkDir() returned %v\n", err)
 		return err
 	}
-	for _, v := range tpl.templatefile.files {
+	templates := make(map[string]*template.Template)
+	pools := make(map[string]*sync.Pool)
+	buildErrors := make(map[string]error)
+	for _, v := range templatefile.files {
 		for _, file := range v {
-			t, err := tpl.getTemplate(tpl.templatefile.root, file, v...)
+			t, err := tpl.getTemplate(templatefile.fsys, file, v...)
+			if err == nil {
+				err = checkTemplates(t)
+			}
 			if err != nil {
-				//Trace("parse template err:", file, err)
+				buildErrors[file] = err
 			} else {
-				tpl.Templates[file] = t
+				templates[file] = t
+				pools[file] = funcsPool(t)
 			}
 		}
 	}
+	// built aside, the requests served meanwhile use the former templates
+	tpl.lock.Lock()
+	tpl.templatefile = templatefile
+	tpl.Templates = templates
+	tpl.pools = pools
+	tpl.errors = buildErrors
+	tpl.lock.Unlock()
+	if len(buildErrors) == 0 {
+		return nil
+	}
+	messages := []string{}
+	for _, err := range buildErrors {
+		messages = append(messages, err.Error())
+	}
+	sort.Strings(messages)
+	return errors.New(strings.Join(messages, "\n"))
+}
+
+// Lookup returns the template parsed from the file name, relative to the
+// template path. An Application in Debug reloads its engines when a file of
+// the template path changed.
+func (tpl *Template) Lookup(name string) (*template.Template, bool) {
+	tpl.lock.RLock()
+	defer tpl.lock.RUnlock()
+	t, ok := tpl.Templates[name]
+	return t, ok
+}
+
+// Load builds the templates of the files of fsys accepted by match, it
+// implements TemplateEngine.
+func (tpl *Template) Load(fsys fs.FS, match func(name string) bool) error {
+	tpl.lock.Lock()
+	tpl.match = match
+	tpl.lock.Unlock()
+	return tpl.BuildTemplateFS(fsys)
+}
+
+// Reload builds the templates again.
+func (tpl *Template) Reload() error {
+	tpl.lock.RLock()
+	fsys := tpl.fsys
+	tpl.lock.RUnlock()
+	if fsys == nil {
+		return nil
+	}
+	return tpl.BuildTemplateFS(fsys)
+}
+
+// Names returns the names of the templates built, sorted.
+func (tpl *Template) Names() []string {
+	tpl.lock.RLock()
+	defer tpl.lock.RUnlock()
+	names := make([]string, 0, len(tpl.Templates))
+	for name := range tpl.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Render executes the template name with data into w, funcs replace the
+// functions of the same name. A template whose file cannot be parsed
+// returns its error.
+func (tpl *Template) Render(w io.Writer, name string, data interface{}, funcs map[string]interface{}) error {
+	t, ok := tpl.Lookup(name)
+	if !ok {
+		if err := tpl.Error(name); err != nil {
+			return err
+		}
+		return ErrTemplateNotFound
+	}
+	if len(funcs) != 0 {
+		var release func()
+		var err error
+		if t, release, err = tpl.withFuncs(name, funcs); err != nil {
+			return err
+		}
+		defer release()
+	}
+	return t.ExecuteTemplate(w, name, data)
+}
+
+// funcsPool returns the pool of the clones of t given to the requests with
+// functions of their own. Once executed an html template cannot be cloned
+// any more, so the clones are made from a copy of t taken before.
+func funcsPool(t *template.Template) *sync.Pool {
+	pristine, err := t.Clone()
+	return &sync.Pool{New: func() interface{} {
+		if err != nil {
+			return err
+		}
+		clone, err := pristine.Clone()
+		if err != nil {
+			return err
+		}
+		return clone
+	}}
+}
+
+// withFuncs returns a clone of the template name with funcs, which only the
+// caller executes, the template itself is shared by the requests. release
+// gives the clone back to the pool once executed, with the functions of
+// FuncMap again.
+func (tpl *Template) withFuncs(name string, funcs map[string]interface{}) (*template.Template, func(), error) {
+	pool := tpl.poolOf(name)
+	if pool == nil {
+		return nil, nil, ErrTemplateNotFound
+	}
+	t, err := pooledTemplate(pool.Get())
+	if err != nil {
+		return nil, nil, err
+	}
+	t.Funcs(funcs)
+	release := func() {
+		restore := template.FuncMap{}
+		for key := range funcs {
+			function, ok := tpl.FuncMap[key]
+			if !ok {
+				// cannot be restored, the clone is dropped
+				return
+			}
+			restore[key] = function
+		}
+		t.Funcs(restore)
+		pool.Put(t)
+	}
+	return t, release, nil
+}
+
+// newWithFuncs returns a new clone of the template name with funcs, which
+// is not taken from the pool and not given back, see CreateTemplateLoader.
+func (tpl *Template) newWithFuncs(name string, funcs map[string]interface{}) (*template.Template, error) {
+	pool := tpl.poolOf(name)
+	if pool == nil {
+		return nil, ErrTemplateNotFound
+	}
+	t, err := pooledTemplate(pool.New())
+	if err != nil {
+		return nil, err
+	}
+	return t.Funcs(funcs), nil
+}
+
+// poolOf returns the pool of the clones of the template name, nil if
+// there is none.
+func (tpl *Template) poolOf(name string) *sync.Pool {
+	tpl.lock.RLock()
+	defer tpl.lock.RUnlock()
+	return tpl.pools[name]
+}
+
+// pooledTemplate returns the clone made by a pool of funcsPool, or the
+// error it got.
+func pooledTemplate(clone interface{}) (*template.Template, error) {
+	if err, ok := clone.(error); ok {
+		return nil, err
+	}
+	return clone.(*template.Template), nil
+}
+
+// Error returns the error of the file name, nil if it was parsed.
+func (tpl *Template) Error(name string) error {
+	tpl.lock.RLock()
+	defer tpl.lock.RUnlock()
+	return tpl.errors[name]
+}
+
+// checkTemplates returns an error if a template of t calls one which is not
+// defined, the call would only fail when executed.
+func checkTemplates(t *template.Template) error {
+	associated := t.Templates()
+	sort.Slice(associated, func(i, j int) bool { return associated[i].Name() < associated[j].Name() })
+	for _, at := range associated {
+		if at.Tree == nil {
+			continue
+		}
+		if err := checkNode(t, at.Tree, at.Tree.Root); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (tpl *Template) getTplDeep(root, file, parent string, t *template.Template) (*template.Template, [][]string, error) {
-	var fileabspath string
-	if filepath.HasPrefix(file, "../") {
-		fileabspath = filepath.Join(root, filepath.Dir(parent), file)
-	} else {
-		fileabspath = filepath.Join(root, file)
+func checkNode(t *template.Template, tree *parse.Tree, node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := checkNode(t, tree, child); err != nil {
+				return err
+			}
+		}
+	case *parse.IfNode:
+		return checkBranch(t, tree, &n.BranchNode)
+	case *parse.RangeNode:
+		return checkBranch(t, tree, &n.BranchNode)
+	case *parse.WithNode:
+		return checkBranch(t, tree, &n.BranchNode)
+	case *parse.TemplateNode:
+		if t.Lookup(n.Name) == nil {
+			location, _ := tree.ErrorContext(n)
+			return errors.New(fmt.Sprintf("template: %s: no such template %q", location, n.Name))
+		}
+	}
+	return nil
+}
+
+func checkBranch(t *template.Template, tree *parse.Tree, branch *parse.BranchNode) error {
+	if err := checkNode(t, tree, branch.List); err != nil {
+		return err
 	}
-	if e := tpl.FileExists(fileabspath); !e {
-		panic("can't find template file:" + file)
+	return checkNode(t, tree, branch.ElseList)
+}
+
+func (tpl *Template) getTplDeep(fsys fs.FS, file, parent string, t *template.Template) (*template.Template, [][]string, error) {
+	filename := templateFilePath(file, parent)
+	if e := templateFileExists(fsys, filename); !e {
+		return nil, [][]string{}, errors.New("can't find template file: " + file)
 	}
-	data, err := ioutil.ReadFile(fileabspath)
+	data, err := fs.ReadFile(fsys, filename)
 	if err != nil {
 		return nil, [][]string{}, err
 	}
@@ -137,10 +374,14 @@ func (tpl *Template) getTplDeep(root, file, parent string, t *template.Template)
 			if tlook != nil {
 				continue
 			}
+			if !templateFileExists(fsys, templateFilePath(m[1], file)) {
+				// defined in another file, see _getTemplate
+				continue
+			}
 			//			if !HasTemplateExt(m[1]) {
 			//				continue
 			//			}
-			t, _, err = tpl.getTplDeep(root, m[1], file, t)
+			t, _, err = tpl.getTplDeep(fsys, m[1], file, t)
 			if err != nil {
 				return nil, [][]string{}, err
 			}
@@ -149,22 +390,104 @@ func (tpl *Template) getTplDeep(root, file, parent string, t *template.Template)
 	return t, allsub, nil
 }
 
-func (tpl *Template) getTemplate(root, file string, others ...string) (t *template.Template, err error) {
+// templateFilePath returns the name in the template fs.FS of the template
+// file, a file starting with "../" is relative to the directory of parent.
+func templateFilePath(file, parent string) string {
+	if strings.HasPrefix(file, "../") {
+		file = path.Join(path.Dir(parent), file)
+	}
+	return strings.TrimPrefix(path.Clean("/"+file), "/")
+}
+
+// templateFileExists reports whether name is a file of fsys.
+func templateFileExists(fsys fs.FS, name string) bool {
+	_, err := fs.Stat(fsys, name)
+	return err == nil
+}
+
+// getTemplate parses file and the templates it calls. A file starting with
+// {{extends "layout.html"}} is parsed after its layouts, so the blocks it
+// defines replace the ones of the layouts, and is rendered by the first
+// layout of the chain.
+func (tpl *Template) getTemplate(fsys fs.FS, file string, others ...string) (t *template.Template, err error) {
 	t = template.New(file).Delims(tpl.LeftBraces, tpl.RightBraces).Funcs(tpl.FuncMap)
-	var submods [][]string
-	t, submods, err = tpl.getTplDeep(root, file, "", t)
+	layouts, err := tpl.getLayouts(fsys, file)
 	if err != nil {
 		return nil, err
 	}
-	t, err = tpl._getTemplate(t, root, submods, others...)
+	var submods [][]string
+	for _, layout := range layouts {
+		var layoutSubmods [][]string
+		t, layoutSubmods, err = tpl.getTplDeep(fsys, layout, "", t)
+		if err != nil {
+			return nil, err
+		}
+		submods = append(submods, layoutSubmods...)
+	}
+	t, err = tpl._getTemplate(t, fsys, submods, others...)
 
 	if err != nil {
 		return nil, err
 	}
+	if len(layouts) > 1 {
+		t, err = t.AddParseTree(file, t.Lookup(layouts[0]).Tree.Copy())
+	}
 	return
 }
 
-func (tpl *Template) _getTemplate(t0 *template.Template, root string, submods [][]string, others ...string) (t *template.Template, err error) {
+// getLayouts returns the chain of layouts extended by file, from the one
+// extending no other to file itself. The layouts are relative to the root
+// of fsys.
+func (tpl *Template) getLayouts(fsys fs.FS, file string) ([]string, error) {
+	layouts := []string{file}
+	for current := file; ; {
+		data, err := fs.ReadFile(fsys, templateFilePath(current, ""))
+		if err != nil {
+			return nil, err
+		}
+		parent, line, err := tpl.parseExtends(current, string(data))
+		if err != nil {
+			return nil, err
+		}
+		if len(parent) == 0 {
+			return layouts, nil
+		}
+		for _, layout := range layouts {
+			if layout == parent {
+				chain := append([]string{parent}, layouts...)
+				return nil, errors.New(fmt.Sprintf("template: %s:%d: extends %q makes a cycle: %s", current, line, parent, strings.Join(chain, " extends ")))
+			}
+		}
+		if !templateFileExists(fsys, templateFilePath(parent, "")) {
+			return nil, errors.New(fmt.Sprintf("template: %s:%d: extends %q, no such template file", current, line, parent))
+		}
+		layouts = append([]string{parent}, layouts...)
+		current = parent
+	}
+}
+
+// parseExtends returns the layout the template file extends and the line
+// of the extends action, "" if it extends none. The action must be the
+// first one of the file.
+func (tpl *Template) parseExtends(file, data string) (string, int, error) {
+	left, right := regexp.QuoteMeta(tpl.LeftBraces), regexp.QuoteMeta(tpl.RightBraces)
+	actions := regexp.MustCompile(left+`-?\s*extends\b`).FindAllStringIndex(data, -1)
+	if len(actions) == 0 {
+		return "", 0, nil
+	}
+	line := strings.Count(data[:actions[0][0]], "\n") + 1
+	if len(actions) > 1 {
+		line = strings.Count(data[:actions[1][0]], "\n") + 1
+		return "", 0, errors.New(fmt.Sprintf("template: %s:%d: extends given twice", file, line))
+	}
+	first := regexp.MustCompile(`^\s*` + left + `-?\s*extends\s+"([^"]+)"\s*-?` + right).FindStringSubmatch(data)
+	if first == nil {
+		return "", 0, errors.New(fmt.Sprintf("template: %s:%d: extends must be the first action, with the name of the layout in double quotes", file, line))
+	}
+	return first[1], line, nil
+}
+
+func (tpl *Template) _getTemplate(t0 *template.Template, fsys fs.FS, submods [][]string, others ...string) (t *template.Template, err error) {
 	t = t0
 	for _, m := range submods {
 		if len(m) == 2 {
@@ -176,19 +499,20 @@ func (tpl *Template) _getTemplate(t0 *template.Template, root string, submods []
 			for _, otherfile := range others {
 				if otherfile == m[1] {
 					var submods1 [][]string
-					t, submods1, err = tpl.getTplDeep(root, otherfile, "", t)
+					t, submods1, err = tpl.getTplDeep(fsys, otherfile, "", t)
 					if err != nil {
-						//Trace("template parse file err:", err)
+						return nil, err
 					} else if submods1 != nil && len(submods1) > 0 {
-						t, err = tpl._getTemplate(t, root, submods1, others...)
+						if t, err = tpl._getTemplate(t, fsys, submods1, others...); err != nil {
+							return nil, err
+						}
 					}
 					break
 				}
 			}
 			//second check define
 			for _, otherfile := range others {
-				fileabspath := filepath.Join(root, otherfile)
-				data, err := ioutil.ReadFile(fileabspath)
+				data, err := fs.ReadFile(fsys, otherfile)
 				if err != nil {
 					continue
 				}
@@ -197,11 +521,13 @@ func (tpl *Template) _getTemplate(t0 *template.Template, root string, submods []
 				for _, sub := range allsub {
 					if len(sub) == 2 && sub[1] == m[1] {
 						var submods1 [][]string
-						t, submods1, err = tpl.getTplDeep(root, otherfile, "", t)
+						t, submods1, err = tpl.getTplDeep(fsys, otherfile, "", t)
 						if err != nil {
-							//Trace("template parse file err:", err)
+							return nil, err
 						} else if submods1 != nil && len(submods1) > 0 {
-							t, err = tpl._getTemplate(t, root, submods1, others...)
+							if t, err = tpl._getTemplate(t, fsys, submods1, others...); err != nil {
+								return nil, err
+							}
 						}
 						break
 					}
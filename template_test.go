@@ -0,0 +1,280 @@
+package lemon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type renderHandler struct {
+	RequestHandler
+}
+
+func (h *renderHandler) Get(args ...string) {
+	h.Render(args[0], map[string]interface{}{"Name": "bob"})
+}
+
+// writeTemplate writes the file name of dir, its modification time is moved
+// by the length of body so that a rewrite is seen in the same second.
+func writeTemplate(t testing.TB, dir, name, body string) {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Duration(len(body)) * time.Second)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serveGet(app *Application, path string) (int, string) {
+	rw := serveRequest(app, "GET", path)
+	return rw.Code, rw.Body.String()
+}
+
+func serveRequest(app *Application, method, path string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	app.ServeHTTP(rw, httptest.NewRequest(method, path, nil))
+	return rw
+}
+
+// countingEngine counts the reloads of a TextTemplate.
+type countingEngine struct {
+	*TextTemplate
+	reloads int32
+}
+
+func (e *countingEngine) Reload() error {
+	atomic.AddInt32(&e.reloads, 1)
+	return e.TextTemplate.Reload()
+}
+
+func TestDebugReloadsEveryEngine(t *testing.T) {
+	defer func(interval time.Duration) { watchInterval = interval }(watchInterval)
+	watchInterval = 0
+	dir := t.TempDir()
+	writeTemplate(t, dir, "page.html", "html {{.Name}}")
+	writeTemplate(t, dir, "page.txt", "text {{.Name}}")
+	engine := &countingEngine{TextTemplate: NewTextTemplate("", "")}
+	app := NewApplication()
+	app.Init([]UrlSpec{AddRouter("/(.*)", &renderHandler{}, nil, "")},
+		map[string]interface{}{"CookieSecret": "secret", "TemplatePath": dir,
+			"TemplateEngines": map[string]TemplateEngine{".txt": engine}})
+	if _, body := serveGet(app, "/page.txt"); body != "text bob" {
+		t.Fatalf("page.txt: %q", body)
+	}
+
+	writeTemplate(t, dir, "page.txt", "text changed {{.Name}}")
+	writeTemplate(t, dir, "page.html", "html changed {{.Name}}")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveGet(app, "/page.txt")
+		}()
+	}
+	wg.Wait()
+	if reloads := atomic.LoadInt32(&engine.reloads); reloads != 1 {
+		t.Errorf("%d reloads for one change", reloads)
+	}
+	if _, body := serveGet(app, "/page.txt"); body != "text changed bob" {
+		t.Errorf("page.txt after the change: %q", body)
+	}
+	if _, body := serveGet(app, "/page.html"); body != "html changed bob" {
+		t.Errorf("page.html after the change: %q", body)
+	}
+}
+
+// funcsHandler renders with a function of its own, who returns the id of
+// the request.
+type funcsHandler struct {
+	RequestHandler
+	id string
+}
+
+func (h *funcsHandler) Get(args ...string) {
+	h.id = h.GetArgument("id")
+	h.Render(args[0], map[string]interface{}{"Name": "bob"})
+}
+
+func (h *funcsHandler) FunctionsMap() map[string]interface{} {
+	id := h.id
+	return map[string]interface{}{"who": func() string { return id }}
+}
+
+// loaderHandler executes the template of CreateTemplateLoader.
+type loaderHandler struct {
+	funcsHandler
+}
+
+func (h *loaderHandler) Get(args ...string) {
+	h.id = h.GetArgument("id")
+	var page bytes.Buffer
+	if err := h.CreateTemplateLoader(args[0]).ExecuteTemplate(&page, args[0], nil); err != nil {
+		panic(err)
+	}
+	h.Write(page.Bytes())
+}
+
+// TestRenderConcurrentFuncs checks the functions of a request are not seen
+// by the others rendering the same template, run it with -race.
+func TestRenderConcurrentFuncs(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "page.html", `<p>{{who}} {{.Name}} {{template "inc.html" .}}</p>`)
+	writeTemplate(t, dir, "inc.html", `[{{who}}]`)
+	app := NewApplication()
+	app.Init([]UrlSpec{
+		AddRouter("/loader/(.*)", &loaderHandler{}, nil, ""),
+		AddRouter("/(.*)", &funcsHandler{}, nil, ""),
+	}, map[string]interface{}{"CookieSecret": "secret", "TemplatePath": dir, "Debug": false})
+	Templates.AddFuncMap("who", func() string { return "default" })
+	if err := Templates.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan string, 20)
+	for g := 0; g < 20; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				id := fmt.Sprintf("g%di%d", g, i)
+				path, want := "/page.html", fmt.Sprintf("<p>%s bob [%s]</p>", id, id)
+				if i%5 == 0 {
+					path, want = "/loader/page.html", fmt.Sprintf("<p>%s  [%s]</p>", id, id)
+				}
+				if code, body := serveGet(app, path+"?id="+id); code != 200 || body != want {
+					errs <- fmt.Sprintf("%s: %d %q, want %q", path, code, body, want)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	var page bytes.Buffer
+	if err := Templates.Render(&page, "page.html", map[string]interface{}{"Name": "bob"}, nil); err != nil || !strings.Contains(page.String(), "default") {
+		t.Errorf("shared template: %q %v", page.String(), err)
+	}
+}
+
+func TestTemplateExtends(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "admin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTemplate(t, dir, "base.html", `<title>{{block "title" .}}Lemon{{end}}</title><body>{{block "content" .}}{{end}}</body>`)
+	writeTemplate(t, dir, "admin/layout.html", "{{extends \"base.html\"}}\n"+
+		`{{define "content"}}<nav>{{block "menu" .}}menu{{end}}</nav>{{block "main" .}}{{end}}{{end}}`)
+	writeTemplate(t, dir, "admin/users.html", "{{extends \"admin/layout.html\"}}\n"+
+		`{{define "title"}}Users{{end}}{{define "main"}}{{range .Users}}<p>{{.}}</p>{{end}}{{end}}ignored`)
+	writeTemplate(t, dir, "cycle-a.html", "{{extends \"cycle-b.html\"}}")
+	writeTemplate(t, dir, "cycle-b.html", "\n{{extends \"cycle-c.html\"}}")
+	writeTemplate(t, dir, "cycle-c.html", "{{extends \"cycle-a.html\"}}")
+	writeTemplate(t, dir, "self.html", "{{extends \"self.html\"}}")
+	writeTemplate(t, dir, "orphan.html", "\n\n{{ extends \"missing.html\" }}{{define \"title\"}}x{{end}}")
+	writeTemplate(t, dir, "child-of-orphan.html", "{{extends \"orphan.html\"}}")
+	writeTemplate(t, dir, "twice.html", "{{extends \"base.html\"}}\n{{extends \"base.html\"}}")
+	writeTemplate(t, dir, "late.html", "<p>\n</p>{{extends \"base.html\"}}")
+	tpl := TemplateInit("{{", "}}")
+	if err := tpl.BuildTemplate(dir); err == nil {
+		t.Fatal("the broken templates are built")
+	}
+
+	var page bytes.Buffer
+	if err := tpl.Render(&page, "admin/users.html", map[string]interface{}{"Users": []string{"ann", "bob"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := "<title>Users</title><body><nav>menu</nav><p>ann</p><p>bob</p></body>"; page.String() != want {
+		t.Errorf("3 levels: %q, want %q", page.String(), want)
+	}
+	page.Reset()
+	if err := tpl.Render(&page, "admin/layout.html", nil, nil); err != nil || page.String() != "<title>Lemon</title><body><nav>menu</nav></body>" {
+		t.Errorf("2 levels: %q %v", page.String(), err)
+	}
+
+	for name, want := range map[string]string{
+		"cycle-a.html":         `template: cycle-c.html:1: extends "cycle-a.html" makes a cycle: cycle-a.html extends cycle-c.html extends cycle-b.html extends cycle-a.html`,
+		"cycle-b.html":         `template: cycle-a.html:1: extends "cycle-b.html" makes a cycle`,
+		"self.html":            `template: self.html:1: extends "self.html" makes a cycle: self.html extends self.html`,
+		"orphan.html":          `template: orphan.html:3: extends "missing.html", no such template file`,
+		"child-of-orphan.html": `template: orphan.html:3: extends "missing.html", no such template file`,
+		"twice.html":           `template: twice.html:2: extends given twice`,
+		"late.html":            `template: late.html:2: extends must be the first action`,
+	} {
+		if err := tpl.Error(name); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: %v, want %s", name, err, want)
+		}
+		if _, ok := tpl.Lookup(name); ok {
+			t.Errorf("%s is built", name)
+		}
+	}
+}
+
+func BenchmarkRenderWithFuncs(b *testing.B) {
+	dir := b.TempDir()
+	writeTemplate(b, dir, "page.html", `<ul>{{range .Items}}<li><a href="/item/{{.}}">{{who}} {{.}}</a></li>{{end}}</ul>{{template "inc.html" .}}`)
+	writeTemplate(b, dir, "inc.html", `<footer>{{who}} <script>var name = {{.Name}};</script></footer>`)
+	tpl := TemplateInit("{{", "}}")
+	tpl.AddFuncMap("who", func() string { return "default" })
+	if err := tpl.BuildTemplate(dir); err != nil {
+		b.Fatal(err)
+	}
+	data := map[string]interface{}{"Name": "bob", "Items": []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}}
+	for _, bench := range []struct {
+		name  string
+		funcs map[string]interface{}
+	}{
+		{"nofuncs", nil}, // the baseline, the shared templates are executed
+		{"funcs", map[string]interface{}{"who": func() string { return "request" }}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := tpl.Render(io.Discard, "page.html", data, bench.funcs); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// wrappingRender overrides RenderByte, wrapping the page of the engine.
+type wrappingRender struct {
+	renderHandler
+}
+
+func (h *wrappingRender) RenderByte(templateName string, context map[string]interface{}) []byte {
+	return append([]byte("<main>"), append(h.RequestHandler.RenderByte(templateName, context), "</main>"...)...)
+}
+
+func TestRenderCallsRenderByteOverride(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "page.html", "<p>{{.Name}}</p>")
+	app := NewApplication()
+	app.Init([]UrlSpec{
+		AddRouter("/wrapped/(.*)", &wrappingRender{}, nil, ""),
+		AddRouter("/(.*)", &renderHandler{}, nil, ""),
+	}, map[string]interface{}{"CookieSecret": "secret", "TemplatePath": dir})
+	if code, body := serveGet(app, "/wrapped/page.html"); code != 200 || body != "<main><p>bob</p></main>" {
+		t.Errorf("with RenderByte overridden: %d %q", code, body)
+	}
+	if code, body := serveGet(app, "/page.html"); code != 200 || body != "<p>bob</p>" {
+		t.Errorf("without RenderByte overridden: %d %q", code, body)
+	}
+}
@@ -0,0 +1,131 @@
+package lemon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrTemplateNotFound is returned by TemplateEngine.Render for a template
+// it did not load.
+var ErrTemplateNotFound = errors.New("template not found")
+
+// TemplateEngine loads and renders the templates of TemplatePath, or of
+// TemplateFS if it is set. The
+// engines are registered in Application.TemplateEngines by the extension of
+// the template names, the html/template engine Templates renders the other
+// ones.
+type TemplateEngine interface {
+	// Load parses the files of fsys accepted by match, match is given the
+	// name of the file in fsys.
+	Load(fsys fs.FS, match func(name string) bool) error
+	// Render executes the template name with data into w, funcs are the
+	// functions of the request, see RequestHandler.FunctionsMap.
+	Render(w io.Writer, name string, data interface{}, funcs map[string]interface{}) error
+	// Reload parses the files again.
+	Reload() error
+	// Names returns the names of the templates loaded.
+	Names() []string
+}
+
+// loadTemplates loads every engine of TemplateEngines, with the default
+// one Templates unless IsCustomedTemplate is set.
+func (app *Application) loadTemplates() {
+	if app.TemplateEngines == nil {
+		app.TemplateEngines = map[string]TemplateEngine{}
+	}
+	if _, ok := app.TemplateEngines[""]; !ok && !app.IsCustomedTemplate {
+		app.TemplateEngines[""] = Templates
+	}
+	extensions := []string{}
+	for extension := range app.TemplateEngines {
+		extensions = append(extensions, extension)
+	}
+	sort.Strings(extensions)
+	app.templateWatcher = &fileWatcher{}
+	app.templateWatcher.reset(scanFS(app.templateFS(), false))
+	messages := []string{}
+	for _, extension := range extensions {
+		if err := app.loadTemplateEngine(extension); err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	if len(messages) == 0 {
+		return
+	}
+	if app.PrecompileTemplates {
+		errLog := fmt.Sprintf("invalid templates:\n%s", strings.Join(messages, "\n"))
+		lemonLag.Error(errLog)
+		panic(errLog)
+	}
+	lemonLag.Error(strings.Join(messages, "\n"))
+}
+
+// loadTemplateEngine loads the engine of extension with the files of that
+// extension, the default engine "" with the files of no other engine.
+func (app *Application) loadTemplateEngine(extension string) error {
+	match := func(name string) bool {
+		if len(extension) != 0 {
+			return filepath.Ext(name) == extension
+		}
+		_, ok := app.TemplateEngines[filepath.Ext(name)]
+		return !ok
+	}
+	return app.TemplateEngines[extension].Load(app.templateFS(), match)
+}
+
+// AddTemplateEngine registers engine for the templates whose name ends with
+// extension, e.g. ".txt", and loads it. The default engine is replaced if
+// extension is "". The engines given by the TemplateEngines setting are
+// loaded by Init.
+func (app *Application) AddTemplateEngine(extension string, engine TemplateEngine) error {
+	if app.TemplateEngines == nil {
+		app.TemplateEngines = map[string]TemplateEngine{}
+	}
+	app.TemplateEngines[extension] = engine
+	if err := app.loadTemplateEngine(extension); err != nil {
+		return err
+	}
+	if engine, ok := app.TemplateEngines[""]; ok && len(extension) != 0 {
+		// its files are not the default engine's any more
+		return engine.Reload()
+	}
+	return nil
+}
+
+// ReloadTemplates parses the templates of every engine again.
+func (app *Application) ReloadTemplates() error {
+	messages := []string{}
+	for _, engine := range app.TemplateEngines {
+		if err := engine.Reload(); err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	sort.Strings(messages)
+	return errors.New(strings.Join(messages, "\n"))
+}
+
+// templateEngine returns the engine rendering the template name, nil if
+// there is none. In Debug every engine is reloaded first if a template file
+// changed.
+func (app *Application) templateEngine(name string) TemplateEngine {
+	if app.Debug && app.templateWatcher != nil {
+		app.templateWatcher.check(app.templateFS(), func() {
+			lemonLag.Info("templates changed, parsing them again")
+			if err := app.ReloadTemplates(); err != nil {
+				lemonLag.Error(err.Error())
+			}
+		})
+	}
+	if engine, ok := app.TemplateEngines[filepath.Ext(name)]; ok {
+		return engine
+	}
+	return app.TemplateEngines[""]
+}
@@ -8,6 +8,13 @@ import (
 	"time"
 )
 
+// Extends marks the layout a template extends, {{extends "layout.html"}}.
+// It renders nothing, the template is rendered by the layout with the
+// blocks it defines.
+func Extends(layout string) string {
+	return ""
+}
+
 // Substr returns the substr from start to length.
 func Substr(s string, start, length int) string {
 	bt := []rune(s)
@@ -0,0 +1,127 @@
+package lemon
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// TextTemplate is a TemplateEngine parsing the files with text/template,
+// for the templates which are not html, e.g. mails or plain text which
+// html/template would escape. All the files are parsed together, so a
+// template calls another one by its name relative to the root.
+type TextTemplate struct {
+	FuncMap     map[string]interface{}
+	LeftBraces  string
+	RightBraces string
+	lock        sync.RWMutex
+	fsys        fs.FS
+	match       func(string) bool
+	templates   *template.Template
+	errors      map[string]error // the files which cannot be parsed
+}
+
+// NewTextTemplate returns a TextTemplate with the functions of Templates,
+// to register for an extension, e.g.
+//
+//	settings["TemplateEngines"] = map[string]lemon.TemplateEngine{
+//		".txt": lemon.NewTextTemplate("{{", "}}"),
+//	}
+func NewTextTemplate(leftBraces, rightBraces string) *TextTemplate {
+	funcMap := make(map[string]interface{})
+	for key, function := range TemplateInit(leftBraces, rightBraces).FuncMap {
+		funcMap[key] = function
+	}
+	return &TextTemplate{FuncMap: funcMap, LeftBraces: leftBraces, RightBraces: rightBraces}
+}
+
+// Load parses the files of fsys accepted by match. The files which cannot
+// be parsed are left out and the error lists them.
+func (tt *TextTemplate) Load(fsys fs.FS, match func(name string) bool) error {
+	tt.lock.Lock()
+	tt.fsys, tt.match = fsys, match
+	tt.lock.Unlock()
+	return tt.Reload()
+}
+
+// Reload parses the files again, the templates are replaced at once.
+func (tt *TextTemplate) Reload() error {
+	tt.lock.RLock()
+	fsys, match := tt.fsys, tt.match
+	tt.lock.RUnlock()
+	if fsys == nil {
+		return nil
+	}
+	templates := template.New("").Delims(tt.LeftBraces, tt.RightBraces).Funcs(tt.FuncMap)
+	parseErrors := map[string]error{}
+	messages := []string{}
+	fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if match != nil && !match(name) {
+			return nil
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err == nil {
+			_, err = templates.New(name).Parse(string(data))
+		}
+		if err != nil {
+			parseErrors[name] = err
+			messages = append(messages, err.Error())
+		}
+		return nil
+	})
+	tt.lock.Lock()
+	tt.templates, tt.errors = templates, parseErrors
+	tt.lock.Unlock()
+	if len(messages) == 0 {
+		return nil
+	}
+	sort.Strings(messages)
+	return errors.New(strings.Join(messages, "\n"))
+}
+
+// Render executes the template name with data into w, funcs replace the
+// functions of the same name. A template whose file cannot be parsed
+// returns its error.
+func (tt *TextTemplate) Render(w io.Writer, name string, data interface{}, funcs map[string]interface{}) error {
+	tt.lock.RLock()
+	templates, err := tt.templates, tt.errors[name]
+	tt.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	if templates == nil || templates.Lookup(name) == nil {
+		return ErrTemplateNotFound
+	}
+	if len(funcs) != 0 {
+		clone, err := templates.Clone()
+		if err != nil {
+			return err
+		}
+		templates = clone.Funcs(funcs)
+	}
+	return templates.ExecuteTemplate(w, name, data)
+}
+
+// Names returns the names of the templates loaded, sorted.
+func (tt *TextTemplate) Names() []string {
+	tt.lock.RLock()
+	defer tt.lock.RUnlock()
+	names := []string{}
+	if tt.templates == nil {
+		return names
+	}
+	for _, t := range tt.templates.Templates() {
+		if t.Name() != "" && t.Tree != nil {
+			names = append(names, t.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
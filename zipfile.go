@@ -6,21 +6,47 @@ import (
 	"compress/gzip"
 	"errors"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
 )
 
-var gmfim map[string]*memFileInfo = make(map[string]*memFileInfo)
+var gmfim map[memZipKey]*memFileInfo = make(map[memZipKey]*memFileInfo)
 var lock sync.RWMutex
 
-// OpenMemZipFile returns MemFile object with a compressed static file.
+// memZipKey identifies a compressed file, fsys is the identity of the
+// fs.FS given by fsIdentity.
+type memZipKey struct {
+	fsys interface{}
+	zip  string
+	name string
+}
+
+// fsIdentity returns a comparable value telling fsys from the other fs.FS,
+// nil if there is none, e.g. a struct holding a slice.
+func fsIdentity(fsys fs.FS) interface{} {
+	value := reflect.ValueOf(fsys)
+	if value.Comparable() {
+		return fsys
+	}
+	switch value.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Func:
+		// e.g. a fstest.MapFS
+		return value.Pointer()
+	}
+	return nil
+}
+
+// OpenMemZipFile returns MemFile object with a compressed static file, the
+// file name of fsys.
 // it's used for serve static file if gzip enable.
-func openMemZipFile(path string, zip string) (*memFile, error) {
-	osfile, e := os.Open(path)
+func openMemZipFile(fsys fs.FS, name string, zip string) (*memFile, error) {
+	osfile, e := fsys.Open(name)
 	if e != nil {
 		return nil, e
 	}
@@ -33,8 +59,10 @@ func openMemZipFile(path string, zip string) (*memFile, error) {
 
 	modtime := osfileinfo.ModTime()
 	fileSize := osfileinfo.Size()
+	identity := fsIdentity(fsys)
+	key := memZipKey{identity, zip, name}
 	lock.RLock()
-	cfi, ok := gmfim[zip+":"+path]
+	cfi, ok := gmfim[key]
 	lock.RUnlock()
 	if !(ok && cfi.ModTime() == modtime && cfi.fileSize == fileSize) {
 		var content []byte
@@ -76,9 +104,11 @@ func openMemZipFile(path string, zip string) (*memFile, error) {
 		}
 
 		cfi = &memFileInfo{osfileinfo, modtime, content, int64(len(content)), fileSize}
-		lock.Lock()
-		defer lock.Unlock()
-		gmfim[zip+":"+path] = cfi
+		if identity != nil {
+			lock.Lock()
+			gmfim[key] = cfi
+			lock.Unlock()
+		}
 	}
 	return &memFile{fi: cfi, offset: 0}, nil
 }
@@ -196,3 +226,10 @@ func getAcceptEncodingZip(r *http.Request) string {
 		return ""
 	}
 }
+
+// clearMemZipFiles drops the compressed copies of the static files.
+func clearMemZipFiles() {
+	lock.Lock()
+	defer lock.Unlock()
+	gmfim = make(map[memZipKey]*memFileInfo)
+}